@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The names of the artifacts archived for every run
+	ARTIFACT_SOURCE_HTML = "source.html"
+	ARTIFACT_BADGE_HTML  = "badge.html"
+	ARTIFACT_BADGE_PNG   = "badge.png"
+	ARTIFACT_BADGE_DIFF  = "badge-diff.png"
+	// RUNS_PREFIX is the prefix every run's artifacts are archived beneath
+	RUNS_PREFIX = "runs/"
+	// LATEST_PREFIX holds a copy of the most recent successful run's artifacts, at a stable address
+	LATEST_PREFIX = "latest/"
+	// MANIFEST_KEY is the JSON manifest listing every archived run
+	MANIFEST_KEY = "manifest.json"
+	// The statuses a run is recorded in the manifest with, depending on whether its badge reached every target
+	RUN_DELIVERED = "delivered"
+	RUN_FAILED    = "failed"
+)
+
+// Run identifies a single execution of the badge rotator, and records the artifacts it archived
+type Run struct {
+	ID        string     `json:"id"`
+	StartedAt time.Time  `json:"started_at"`
+	User      string     `json:"user"`
+	Stats     BadgeStats `json:"stats"`
+	// Status is RUN_DELIVERED if the badge reached every target, or RUN_FAILED if delivery failed or was blocked
+	Status string `json:"status"`
+	// Artifacts maps each archived artifact's name onto the SHA-256 of its contents
+	Artifacts map[string]string `json:"artifacts"`
+}
+
+// artifactsLock guards every run's Artifacts, since the badge is delivered to several targets at once and each archives its own
+// visual diff
+var artifactsLock sync.Mutex
+
+// delivered reports whether the run's badge reached every target
+func (r Run) delivered() bool {
+	return r.Status == RUN_DELIVERED
+}
+
+// Manifest lists every archived run, oldest first, and which of them is the latest delivered run
+type Manifest struct {
+	Latest string `json:"latest"`
+	Runs   []Run  `json:"runs"`
+}
+
+// newRun creates a run whose ID sorts by start time and is unique even if two runs start in the same second
+func newRun(startedAt time.Time, user string) (*Run, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+
+	return &Run{
+		ID:        fmt.Sprintf("%s-%s", startedAt.UTC().Format("20060102T150405Z"), hex.EncodeToString(suffix)),
+		StartedAt: startedAt,
+		User:      user,
+		Artifacts: map[string]string{},
+	}, nil
+}
+
+// key returns where the named artifact of this run is archived, such as runs/2026-10/<run-id>/badge.png
+func (r *Run) key(name string) string {
+	return fmt.Sprintf("%s%s/%s/%s", RUNS_PREFIX, r.StartedAt.UTC().Format("2006-01"), r.ID, name)
+}
+
+// archiveArtifact streams body into this run's archive under name, recording the SHA-256 of its contents
+func (r *Run) archiveArtifact(store ArtifactStore, name string, body io.Reader) error {
+	hash := sha256.New()
+	err := store.Put(r.key(name), io.TeeReader(body, hash), putOptionsForKey(name))
+	if err != nil {
+		return err
+	}
+	artifactsLock.Lock()
+	defer artifactsLock.Unlock()
+	r.Artifacts[name] = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+// hasArtifact reports whether this run archived the named artifact
+func (r *Run) hasArtifact(name string) bool {
+	artifactsLock.Lock()
+	defer artifactsLock.Unlock()
+	_, ok := r.Artifacts[name]
+	return ok
+}
+
+// archiveFile archives the local file at sourcePath under name
+func (r *Run) archiveFile(store ArtifactStore, name, sourcePath string) error {
+	file, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	return r.archiveArtifact(store, name, file)
+}
+
+// publishRun adds the run to the manifest with the status of its delivery. Only a delivered run becomes the latest: latest/
+// is pointed at it by copying its artifacts there, removing any that an earlier run left behind but this run didn't produce,
+// such as a visual diff. A failed run leaves latest/ at the last delivered run
+func publishRun(store ArtifactStore, run *Run, delivered bool) error {
+	run.Status = RUN_FAILED
+	if delivered {
+		run.Status = RUN_DELIVERED
+		if err := copyRunToLatest(store, run); err != nil {
+			return err
+		}
+	}
+
+	manifest, err := loadManifest(store)
+	if err != nil {
+		return err
+	}
+
+	manifest.Runs = append(manifest.Runs, *run)
+	if delivered {
+		manifest.Latest = run.ID
+	}
+
+	return saveManifest(store, manifest)
+}
+
+// copyRunToLatest replaces the artifacts under latest/ with the run's own
+func copyRunToLatest(store ArtifactStore, run *Run) error {
+	names := make([]string, 0, len(run.Artifacts))
+	for name := range run.Artifacts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		contents, err := store.Get(run.key(name))
+		if err != nil {
+			return err
+		}
+		err = store.Put(LATEST_PREFIX+name, bytes.NewReader(contents), putOptionsForKey(name))
+		if err != nil {
+			return err
+		}
+	}
+
+	latest, err := store.List(LATEST_PREFIX)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range latest {
+		if !run.hasArtifact(strings.TrimPrefix(key, LATEST_PREFIX)) {
+			if err := store.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadManifest reads the manifest from the store, returning an empty manifest if none has been written yet
+func loadManifest(store ArtifactStore) (*Manifest, error) {
+	keys, err := store.List(MANIFEST_KEY)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{Runs: []Run{}}
+	found := false
+	for _, key := range keys {
+		found = found || key == MANIFEST_KEY
+	}
+	if !found {
+		return manifest, nil
+	}
+
+	contents, err := store.Get(MANIFEST_KEY)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(contents, manifest); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", MANIFEST_KEY, err)
+	}
+
+	return manifest, nil
+}
+
+// saveManifest writes the manifest back to the store
+func saveManifest(store ArtifactStore, manifest *Manifest) error {
+	contents, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.Put(MANIFEST_KEY, bytes.NewReader(contents), putOptionsForKey(MANIFEST_KEY))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// uploadHTMLBadge takes the modified HTML page and hosts it in the run's archive so that the HCTI API
+// will be able to fetch it and extract the badge image from it
+func uploadHTMLBadge(store ArtifactStore, run *Run) error {
+	err := run.archiveFile(store, ARTIFACT_BADGE_HTML, BADGE_LOCAL_PATH)
+	if err != nil {
+		fmt.Printf("Error uploading badge HTML %+v\n", err)
+		return err
+	}
+	return nil
+}
+
+// copyExtractedBadgeImage takes in the URL that was returned by the HCTI API, where the extracted, updated badge is hosted,
+// and reads then write it to a local file first. Next, it archives the local file with the rest of the run's artifacts for
+// safe keeping and sanity checking - even though this stored badge is not used itself - you could also link to the copy under
+// latest/ directly and then just keep running this or a similar function to update it in place if you did not want to go through
+// the hassle of programmatically handling the git / Github operations
+func copyExtractedBadgeImage(store ArtifactStore, run *Run, resizedImageURL string, provenance BadgeProvenance) error {
+	response, err := http.Get(resizedImageURL)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return errors.New("Received non 200 response code from HCTI API")
+	}
+
+	file, err := os.Create(EXTRACTED_BADGE_IMAGE_LOCAL_PATH)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	_, err = io.Copy(file, response.Body)
+	if err != nil {
+		return err
+	}
+
+	// Close the file now, since the post-processing step below rewrites it in place
+	file.Close()
+
+	// Make sure HCTI actually rendered our badge before it is stored anywhere or committed to git. The page margin around the
+	// badge is trimmed before its size is checked, the same way post-processing trims it below
+	err = validateBadgeImage(EXTRACTED_BADGE_IMAGE_LOCAL_PATH, defaultTheme)
+	if err != nil {
+		return err
+	}
+
+	// Trim, pad, quantize and re-compress the badge so the file committed to the profile repository stays small
+	opts, err := getPostProcessOptions()
+	if err != nil {
+		return err
+	}
+
+	err = postProcessBadgeImage(EXTRACTED_BADGE_IMAGE_LOCAL_PATH, defaultTheme, opts)
+	if err != nil {
+		return err
+	}
+
+	// Record the badge's source, stats and the tool version in the PNG itself
+	err = embedProvenance(EXTRACTED_BADGE_IMAGE_LOCAL_PATH, provenance)
+	if err != nil {
+		return err
+	}
+
+	err = run.archiveFile(store, ARTIFACT_BADGE_PNG, EXTRACTED_BADGE_IMAGE_LOCAL_PATH)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// splitAssetOutputs separates the target's outputs into the assets written to its assets branch, which are everything but
+// README regions, and the README regions that stay on the base branch. The README regions embed the badge image from the
+// assets branch by its raw URL, which doesn't change from one run to the next
+func splitAssetOutputs(target *Target) ([]BadgeOutput, []BadgeOutput, error) {
+	assets := []BadgeOutput{}
+	embeds := []BadgeOutput{}
+
+	for _, output := range target.Outputs {
+		if output.Kind == OUTPUT_README_REGION {
+			embeds = append(embeds, output)
+			continue
+		}
+		assets = append(assets, output)
+	}
+
+	if len(assets) == 0 {
+		return nil, nil, fmt.Errorf("The assets branch %s needs at least one %s, %s or %s output", target.AssetsBranch,
+			OUTPUT_BADGE_PNG, OUTPUT_BADGE_SVG, OUTPUT_STATS_JSON)
+	}
+
+	if len(embeds) == 0 {
+		return assets, embeds, nil
+	}
+
+	repo, parseErr := target.forgeRepo()
+
+	if parseErr != nil {
+		return nil, nil, fmt.Errorf("README regions embed the badge from the assets branch by its raw URL, which can't be worked out: %v", parseErr)
+	}
+
+	imageURL := repo.RawURL(target.AssetsBranch, primaryBadgePath(assets))
+	for i := range embeds {
+		embeds[i].ImageURL = imageURL
+	}
+
+	return assets, embeds, nil
+}
+
+// updateAssetsBranch writes the badge images and stats to the target's assets branch, an orphan branch holding a single commit
+// that every run replaces, so that a new badge image every month doesn't grow the repository's history:
+// 1. Shallow clone the assets branch into memory, unless this is the first run and it doesn't exist yet
+// 2. Compare the badge on the assets branch with the new badge, and stop if they differ by more than a monthly update would
+// 3. Render the outputs, stopping if none of them changed
+// 4. Commit the outputs, and nothing else, as the first and only commit of a new in-memory repository
+// 5. Force push that commit to the assets branch, replacing the previous run's
+// It returns the SHA of the new commit, which is empty when nothing changed, and what happened to each file
+func updateAssetsBranch(store ArtifactStore, run *Run, target *Target, outputs []BadgeOutput) (string, []FileChange, error) {
+	var existing billy.Filesystem = memfs.New()
+
+	previousRepository, cloneErr := cloneRepo(target, target.AssetsBranch, true)
+
+	switch {
+	case errors.Is(cloneErr, git.NoMatchingRefSpecError{}):
+		fmt.Printf("%s has no %s branch yet, creating it\n", target.RepoURL, target.AssetsBranch)
+	case cloneErr != nil:
+		return "", nil, cloneErr
+	default:
+		previousWorktree, worktreeErr := getLocalWorkTree(previousRepository)
+
+		if worktreeErr != nil {
+			return "", nil, worktreeErr
+		}
+
+		existing = previousWorktree.Filesystem
+	}
+
+	copyErr := copyPreviousBadge(existing, primaryBadgePath(outputs), target.previousBadgePath())
+
+	if copyErr != nil {
+		return "", nil, copyErr
+	}
+
+	visualErr := checkVisualRegression(store, run, target)
+
+	if visualErr != nil {
+		return "", nil, visualErr
+	}
+
+	readExisting := func(filePath string) ([]byte, bool, error) {
+		return readBillyFile(existing, filePath)
+	}
+
+	files, renderErr := renderOutputs(outputs, run, readExisting)
+
+	if renderErr != nil {
+		return "", nil, renderErr
+	}
+
+	changes := []FileChange{}
+	for _, file := range files {
+		contents, found, readErr := readExisting(file.Path)
+
+		if readErr != nil {
+			return "", nil, readErr
+		}
+
+		changes = append(changes, FileChange{Path: file.Path, Status: fileStatus(file.Contents, contents, found)})
+	}
+
+	logFileChanges(changes)
+
+	if !hasChanges(changes) {
+		return "", changes, nil
+	}
+
+	assetsRepository, initErr := git.Init(memory.NewStorage(), memfs.New())
+
+	if initErr != nil {
+		return "", nil, initErr
+	}
+
+	// Point HEAD at the assets branch before it exists, so the commit has no parent and creates the branch
+	branchName := plumbing.NewBranchReferenceName(target.AssetsBranch)
+	headErr := assetsRepository.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branchName))
+
+	if headErr != nil {
+		return "", nil, headErr
+	}
+
+	_, remoteErr := assetsRepository.CreateRemote(&config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{target.RepoURL},
+	})
+
+	if remoteErr != nil {
+		return "", nil, remoteErr
+	}
+
+	worktree, worktreeErr := getLocalWorkTree(assetsRepository)
+
+	if worktreeErr != nil {
+		return "", nil, worktreeErr
+	}
+
+	if _, writeErr := writeRepoFiles(worktree.Filesystem, files); writeErr != nil {
+		return "", nil, writeErr
+	}
+
+	for _, file := range files {
+		if _, addErr := worktree.Add(file.Path); addErr != nil {
+			return "", nil, addErr
+		}
+	}
+
+	hash, commitErr := commitLocalChanges(worktree, assetsRepository, run, target)
+
+	if commitErr != nil {
+		return "", nil, commitErr
+	}
+
+	pushErr := pushLocalBranch(assetsRepository, target, nil, branchName, true)
+
+	if pushErr != nil {
+		return "", nil, pushErr
+	}
+
+	fmt.Printf("Replaced the %s branch of %s with commit %s\n", target.AssetsBranch, target.RepoURL, hash)
+
+	return hash.String(), changes, nil
+}
+
+// updateBadgeImageViaAssetsBranch delivers the badge to a target with an assets branch. The images and stats replace the
+// assets branch's single commit, then any README regions embedding them are delivered to the base branch like any other
+// output, which only changes anything when the embed itself does, such as the first time the assets branch is used
+func updateBadgeImageViaAssetsBranch(store ArtifactStore, run *Run, target *Target) (DeliveryResult, error) {
+	assets, embeds, splitErr := splitAssetOutputs(target)
+
+	if splitErr != nil {
+		return DeliveryResult{}, splitErr
+	}
+
+	assetsSHA, assetChanges, assetsErr := updateAssetsBranch(store, run, target, assets)
+
+	if assetsErr != nil {
+		return DeliveryResult{}, assetsErr
+	}
+
+	result := DeliveryResult{}
+
+	if len(embeds) > 0 {
+		embedTarget := *target
+		embedTarget.Outputs = embeds
+
+		var embedErr error
+		result, embedErr = updateBadgeImageViaClone(store, run, &embedTarget)
+
+		if embedErr != nil {
+			return DeliveryResult{}, embedErr
+		}
+	}
+
+	result.AssetsBranch = target.AssetsBranch
+	result.AssetsCommitSHA = assetsSHA
+	result.Files = append(assetChanges, result.Files...)
+
+	return result, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// DELIVERY_PULL_REQUEST opens a Pull Request for the badge update, which is merged by hand
+	DELIVERY_PULL_REQUEST = "pull-request"
+	// DELIVERY_DIRECT commits the badge update straight to the base branch, with no Pull Request
+	DELIVERY_DIRECT = "direct"
+	// DELIVERY_AUTO_MERGE opens a Pull Request and merges it as soon as it is mergeable
+	DELIVERY_AUTO_MERGE = "auto-merge"
+	// DELIVERY_REVIEW opens a Pull Request and requests review from DELIVERY_REVIEWERS
+	DELIVERY_REVIEW = "review"
+	// DELIVERY_GIST publishes the badge, its stats and a markdown snippet to a Github gist instead of a repository
+	DELIVERY_GIST = "gist"
+	// MERGEABLE_POLL_ATTEMPTS and MERGEABLE_POLL_INTERVAL bound how long to wait for Github to work out whether a new Pull Request
+	// can be merged, which it does asynchronously after the Pull Request is opened
+	MERGEABLE_POLL_ATTEMPTS = 10
+	MERGEABLE_POLL_INTERVAL = 3 * time.Second
+)
+
+// DeliveryResult reports where the badge update ended up
+type DeliveryResult struct {
+	// CommitSHA is the commit containing the badge update
+	CommitSHA string
+	// PullRequestURL is the Pull Request opened or refreshed for the update, empty for direct commits
+	PullRequestURL string
+	// Merged is true when the update has already landed on the base branch
+	Merged bool
+	// Files reports what the update did to each output written to the repository
+	Files []FileChange
+	// BaseBranch is the branch the update is delivered to
+	BaseBranch string
+	// AssetsBranch is the orphan branch the badge images and stats were written to, if any, and AssetsCommitSHA the commit
+	// that replaced it, which is empty when they were already up to date
+	AssetsBranch    string
+	AssetsCommitSHA string
+	// GistURL is the gist the badge was published to, if any, GistRawURLs the stable raw URLs of its files, and GistUpdated
+	// whether this run changed it
+	GistURL     string
+	GistRawURLs []string
+	GistUpdated bool
+}
+
+// String summarizes the result for logs and the Lambda response
+func (d DeliveryResult) String() string {
+	if d.GistURL != "" {
+		state := "updated"
+		if !d.GistUpdated {
+			state = "already up to date"
+		}
+		return fmt.Sprintf("gist %s (%s), raw URLs: %s", d.GistURL, state, strings.Join(d.GistRawURLs, ", "))
+	}
+
+	if d.AssetsBranch == "" {
+		return d.baseBranchSummary()
+	}
+
+	assets := fmt.Sprintf("assets commit %s on %s", d.AssetsCommitSHA, d.AssetsBranch)
+	if d.AssetsCommitSHA == "" {
+		assets = fmt.Sprintf("assets already up to date on %s", d.AssetsBranch)
+	}
+
+	// Files lists the assets too, so they aren't counted as outputs on the base branch
+	if d.CommitSHA == "" {
+		return fmt.Sprintf("%s, with nothing to change on %s", assets, d.BaseBranch)
+	}
+
+	return fmt.Sprintf("%s, and %s", assets, d.baseBranchSummary())
+}
+
+// baseBranchSummary summarizes what happened on the base branch
+func (d DeliveryResult) baseBranchSummary() string {
+	switch {
+	case d.CommitSHA == "":
+		return fmt.Sprintf("no commit, all %d outputs already up to date on %s", len(d.Files), d.BaseBranch)
+	case d.PullRequestURL != "" && d.Merged:
+		return fmt.Sprintf("merged Pull Request %s (commit %s)", d.PullRequestURL, d.CommitSHA)
+	case d.PullRequestURL != "":
+		return fmt.Sprintf("Pull Request %s (commit %s)", d.PullRequestURL, d.CommitSHA)
+	default:
+		return fmt.Sprintf("commit %s on %s", d.CommitSHA, d.BaseBranch)
+	}
+}
+
+// parseDeliveryMode returns how the badge update is delivered, as set by the DELIVERY_MODE env var or a target's delivery mode
+func parseDeliveryMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return DELIVERY_PULL_REQUEST, nil
+	case DELIVERY_PULL_REQUEST, DELIVERY_DIRECT, DELIVERY_AUTO_MERGE, DELIVERY_REVIEW, DELIVERY_GIST:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("DELIVERY_MODE must be %s, %s, %s, %s or %s, got: %s",
+			DELIVERY_PULL_REQUEST, DELIVERY_DIRECT, DELIVERY_AUTO_MERGE, DELIVERY_REVIEW, DELIVERY_GIST, mode)
+	}
+}
+
+// finishPullRequest carries out the rest of the target's delivery mode once the badge Pull Request is open: labelling,
+// assigning and requesting reviewers for it, then merging it for auto-merge. Review mode requires the target to have reviewers
+func finishPullRequest(forge Forge, cr *ChangeRequest, commitSHA string, target *Target) (DeliveryResult, error) {
+	mode := target.Mode
+
+	result := DeliveryResult{
+		CommitSHA:      commitSHA,
+		PullRequestURL: cr.URL,
+	}
+
+	if mode == DELIVERY_REVIEW && len(target.Reviewers) == 0 {
+		return result, errors.New("DELIVERY_MODE review requires DELIVERY_REVIEWERS, or the target's reviewers, to list at least one reviewer")
+	}
+
+	if err := applyPullRequestMetadata(forge, cr, target.Reviewers); err != nil {
+		return result, err
+	}
+
+	if mode == DELIVERY_AUTO_MERGE {
+		mergeSHA, err := mergeWhenReady(forge, cr)
+		if err != nil {
+			return result, err
+		}
+		// A squashed or merge commit is what landed on the base branch, rather than the branch's own commit
+		if mergeSHA != "" {
+			result.CommitSHA = mergeSHA
+			result.Merged = true
+		}
+	}
+
+	return result, nil
+}
+
+// requestReviewers asks the target's reviewers, from DELIVERY_REVIEWERS unless the target lists its own, to review the Pull
+// Request. Teams are written as org/team-slug, anything else is treated as a username
+func requestReviewers(forge Forge, cr *ChangeRequest, reviewers []string) error {
+	if err := forge.RequestReviewers(cr, reviewers); err != nil {
+		return err
+	}
+
+	fmt.Printf("Requested review of %s from %s\n", cr.URL, strings.Join(reviewers, ", "))
+	return nil
+}
+
+// mergeWhenReady merges the Pull Request with the AUTO_MERGE_METHOD, as soon as the forge allows. It returns the commit the
+// Pull Request was merged as, which is empty when it was set to merge once its checks pass instead
+func mergeWhenReady(forge Forge, cr *ChangeRequest) (string, error) {
+	mergeMethod := os.Getenv("AUTO_MERGE_METHOD")
+	if mergeMethod == "" {
+		mergeMethod = "squash"
+	}
+
+	mergeSHA, err := forge.Merge(cr, mergeMethod)
+	if err != nil {
+		return "", err
+	}
+
+	if mergeSHA != "" {
+		fmt.Printf("Merged %s: %s as commit %s\n", cr.Kind, cr.URL, mergeSHA)
+	}
+
+	return mergeSHA, nil
+}
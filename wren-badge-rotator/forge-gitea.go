@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// GITEA_PAGE_SIZE is how many Pull Requests are listed per request, which Gitea caps at 50 by default
+const GITEA_PAGE_SIZE = 50
+
+// GiteaForge delivers badge updates as Gitea Pull Requests, through the Gitea REST API
+type GiteaForge struct {
+	api      *forgeClient
+	repoPath string
+	fullName string
+	// base is the branch Pull Requests are opened against
+	base string
+}
+
+// giteaPullRequest is the part of the Gitea API's Pull Request representation this tool uses
+type giteaPullRequest struct {
+	Number         int    `json:"number"`
+	HTMLURL        string `json:"html_url"`
+	Merged         bool   `json:"merged"`
+	MergeCommitSHA string `json:"merge_commit_sha"`
+	Head           struct {
+		Ref  string `json:"ref"`
+		SHA  string `json:"sha"`
+		Repo *struct {
+			FullName string `json:"full_name"`
+		} `json:"repo"`
+	} `json:"head"`
+	Base struct {
+		Ref string `json:"ref"`
+	} `json:"base"`
+}
+
+// giteaRepository is the part of the Gitea API's repository representation this tool uses
+type giteaRepository struct {
+	FullName string `json:"full_name"`
+	CloneURL string `json:"clone_url"`
+	Owner    struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+}
+
+// newGiteaForge creates a Gitea API client for the repository, authenticating with an access token, for Pull Requests against
+// base
+func newGiteaForge(repo ForgeRepo, token, base string) *GiteaForge {
+	return &GiteaForge{
+		api:      newForgeClient(repo.APIURL, "Authorization", "token "+token),
+		repoPath: fmt.Sprintf("repos/%s/%s", url.PathEscape(repo.Owner()), url.PathEscape(repo.Name())),
+		fullName: repo.Path,
+		base:     base,
+	}
+}
+
+// pullRequestPath is the API path of a Pull Request
+func (f *GiteaForge) pullRequestPath(cr *ChangeRequest) string {
+	return fmt.Sprintf("%s/pulls/%d", f.repoPath, cr.Number)
+}
+
+// giteaChangeRequest converts a Gitea Pull Request into a ChangeRequest
+func (f *GiteaForge) giteaChangeRequest(pr giteaPullRequest) *ChangeRequest {
+	// The head repository is missing once it has been deleted
+	headRepo := ""
+	if pr.Head.Repo != nil {
+		headRepo = pr.Head.Repo.FullName
+	}
+
+	return &ChangeRequest{
+		Kind:       "Pull Request",
+		Number:     pr.Number,
+		Reference:  fmt.Sprintf("#%d", pr.Number),
+		URL:        pr.HTMLURL,
+		HeadBranch: pr.Head.Ref,
+		HeadSHA:    pr.Head.SHA,
+		HeadRepo:   headRepo,
+		SameRepo:   strings.EqualFold(headRepo, f.fullName),
+	}
+}
+
+// ListChangeRequests lists the open Pull Requests against the base branch. Gitea can't filter Pull Requests by their base
+// branch, so they are filtered here
+func (f *GiteaForge) ListChangeRequests() ([]*ChangeRequest, error) {
+	crs := []*ChangeRequest{}
+
+	for page := 1; ; page++ {
+		prs := []giteaPullRequest{}
+		if _, err := f.api.do("GET", fmt.Sprintf("%s/pulls?state=open&limit=%d&page=%d", f.repoPath, GITEA_PAGE_SIZE, page), nil, &prs); err != nil {
+			return nil, err
+		}
+
+		for _, pr := range prs {
+			if pr.Base.Ref == f.base {
+				crs = append(crs, f.giteaChangeRequest(pr))
+			}
+		}
+
+		if len(prs) < GITEA_PAGE_SIZE {
+			break
+		}
+	}
+
+	return crs, nil
+}
+
+// EnsureFork forks the repository into the FORK_NAMESPACE organization, or the authenticated user's account, unless it has
+// already been forked there. Gitea creates forks before responding, so the fork can be pushed to right away
+func (f *GiteaForge) EnsureFork() (*Fork, error) {
+	namespace := os.Getenv("FORK_NAMESPACE")
+	if namespace == "" {
+		user := struct {
+			Login string `json:"login"`
+		}{}
+		if _, err := f.api.do("GET", "user", nil, &user); err != nil {
+			return nil, err
+		}
+		namespace = user.Login
+	}
+
+	var fork *giteaRepository
+	for page := 1; fork == nil; page++ {
+		forks := []giteaRepository{}
+		if _, err := f.api.do("GET", fmt.Sprintf("%s/forks?limit=%d&page=%d", f.repoPath, GITEA_PAGE_SIZE, page), nil, &forks); err != nil {
+			return nil, err
+		}
+
+		for i := range forks {
+			if strings.EqualFold(forks[i].Owner.Login, namespace) {
+				fork = &forks[i]
+				break
+			}
+		}
+
+		if len(forks) < GITEA_PAGE_SIZE {
+			break
+		}
+	}
+
+	if fork == nil {
+		options := map[string]string{}
+		if os.Getenv("FORK_NAMESPACE") != "" {
+			options["organization"] = namespace
+		}
+
+		fork = &giteaRepository{}
+		if _, err := f.api.do("POST", f.repoPath+"/forks", options, fork); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Forked %s into %s\n", f.fullName, namespace)
+	}
+
+	return &Fork{
+		ID:       fork.FullName,
+		Owner:    fork.Owner.Login,
+		CloneURL: fork.CloneURL,
+	}, nil
+}
+
+// OpenChangeRequest opens a Pull Request of branch against the base branch. A branch in a fork is given to Gitea as
+// owner:branch
+func (f *GiteaForge) OpenChangeRequest(fork *Fork, branch, title, body string) (*ChangeRequest, error) {
+	head := branch
+	if fork != nil {
+		head = fork.Owner + ":" + branch
+	}
+
+	pr := giteaPullRequest{}
+	_, err := f.api.do("POST", f.repoPath+"/pulls", map[string]string{
+		"head":  head,
+		"base":  f.base,
+		"title": title,
+		"body":  body,
+	}, &pr)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.giteaChangeRequest(pr), nil
+}
+
+// UpdateChangeRequest replaces the title and body of a Pull Request
+func (f *GiteaForge) UpdateChangeRequest(cr *ChangeRequest, title, body string) (*ChangeRequest, error) {
+	pr := giteaPullRequest{}
+	_, err := f.api.do("PATCH", f.pullRequestPath(cr), map[string]string{
+		"title": title,
+		"body":  body,
+	}, &pr)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.giteaChangeRequest(pr), nil
+}
+
+// Comment comments on a Pull Request, which Gitea treats as an issue
+func (f *GiteaForge) Comment(cr *ChangeRequest, body string) error {
+	_, err := f.api.do("POST", fmt.Sprintf("%s/issues/%d/comments", f.repoPath, cr.Number), map[string]string{"body": body}, nil)
+	return err
+}
+
+// Close closes a Pull Request without merging it
+func (f *GiteaForge) Close(cr *ChangeRequest) error {
+	_, err := f.api.do("PATCH", f.pullRequestPath(cr), map[string]string{"state": "closed"}, nil)
+	return err
+}
+
+// DeleteBranch deletes a branch of the fork, or of the repository itself
+func (f *GiteaForge) DeleteBranch(fork *Fork, branch string) error {
+	repoPath := f.repoPath
+	if fork != nil {
+		forkRepo := ForgeRepo{Path: fork.ID}
+		repoPath = fmt.Sprintf("repos/%s/%s", url.PathEscape(forkRepo.Owner()), url.PathEscape(forkRepo.Name()))
+	}
+
+	_, err := f.api.do("DELETE", fmt.Sprintf("%s/branches/%s", repoPath, url.PathEscape(branch)), nil, nil)
+	return err
+}
+
+// RequestReviewers asks users, or org/team teams, to review a Pull Request
+func (f *GiteaForge) RequestReviewers(cr *ChangeRequest, reviewers []string) error {
+	users := []string{}
+	teams := []string{}
+	for _, reviewer := range reviewers {
+		if parts := strings.SplitN(reviewer, "/", 2); len(parts) == 2 {
+			teams = append(teams, parts[1])
+			continue
+		}
+		users = append(users, reviewer)
+	}
+
+	_, err := f.api.do("POST", f.pullRequestPath(cr)+"/requested_reviewers", map[string][]string{
+		"reviewers":      users,
+		"team_reviewers": teams,
+	}, nil)
+	return err
+}
+
+// AddLabels adds labels to a Pull Request. Gitea adds labels by ID, so the repository's labels are looked up by name first
+func (f *GiteaForge) AddLabels(cr *ChangeRequest, labels []string) error {
+	ids := map[string]int64{}
+	for page := 1; ; page++ {
+		repoLabels := []struct {
+			ID   int64  `json:"id"`
+			Name string `json:"name"`
+		}{}
+		if _, err := f.api.do("GET", fmt.Sprintf("%s/labels?limit=%d&page=%d", f.repoPath, GITEA_PAGE_SIZE, page), nil, &repoLabels); err != nil {
+			return err
+		}
+		for _, label := range repoLabels {
+			ids[label.Name] = label.ID
+		}
+		if len(repoLabels) < GITEA_PAGE_SIZE {
+			break
+		}
+	}
+
+	labelIDs := []int64{}
+	for _, label := range labels {
+		id, ok := ids[label]
+		if !ok {
+			return fmt.Errorf("No label named %s in %s", label, f.fullName)
+		}
+		labelIDs = append(labelIDs, id)
+	}
+
+	_, err := f.api.do("POST", fmt.Sprintf("%s/issues/%d/labels", f.repoPath, cr.Number), map[string][]int64{"labels": labelIDs}, nil)
+	return err
+}
+
+// AddAssignees sets the Pull Request's assignees
+func (f *GiteaForge) AddAssignees(cr *ChangeRequest, assignees []string) error {
+	_, err := f.api.do("PATCH", f.pullRequestPath(cr), map[string][]string{"assignees": assignees}, nil)
+	return err
+}
+
+// Merge asks Gitea to merge the Pull Request once its status checks succeed, which it does right away if they already have,
+// then returns the commit it was merged as, which is empty when it is waiting for its checks
+func (f *GiteaForge) Merge(cr *ChangeRequest, method string) (string, error) {
+	options := map[string]interface{}{
+		"Do":                        method,
+		"merge_when_checks_succeed": true,
+	}
+	// Guard against merging commits pushed after the badge update
+	if cr.HeadSHA != "" {
+		options["head_commit_id"] = cr.HeadSHA
+	}
+
+	_, err := f.api.do("POST", f.pullRequestPath(cr)+"/merge", options, nil)
+	if err != nil {
+		return "", err
+	}
+
+	pr := giteaPullRequest{}
+	if _, err := f.api.do("GET", f.pullRequestPath(cr), nil, &pr); err != nil {
+		return "", err
+	}
+
+	if !pr.Merged {
+		fmt.Printf("Set Pull Request %s to merge when its checks succeed\n", cr.URL)
+		return "", nil
+	}
+
+	// Gitea versions before 1.13 don't report the merge commit
+	if pr.MergeCommitSHA == "" {
+		return pr.Head.SHA, nil
+	}
+
+	return pr.MergeCommitSHA, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// giteaLabelsPage renders a page of Gitea labels, with IDs counting up from firstID
+func giteaLabelsPage(t *testing.T, firstID int, names ...string) fakeResponse {
+	labels := []map[string]interface{}{}
+	for i, name := range names {
+		labels = append(labels, map[string]interface{}{"id": firstID + i, "name": name})
+	}
+	body, err := json.Marshal(labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fakeResponse{Body: string(body)}
+}
+
+// fullGiteaLabelsPage renders a page of GITEA_PAGE_SIZE labels, so another page is requested after it
+func fullGiteaLabelsPage(t *testing.T, firstID int) fakeResponse {
+	names := []string{}
+	for i := 0; i < GITEA_PAGE_SIZE; i++ {
+		names = append(names, fmt.Sprintf("label-%d", firstID+i))
+	}
+	return giteaLabelsPage(t, firstID, names...)
+}
+
+func TestGiteaAddLabels(t *testing.T) {
+	const (
+		page1  = "GET /api/v1/repos/zack/profile/labels?limit=50&page=1"
+		page2  = "GET /api/v1/repos/zack/profile/labels?limit=50&page=2"
+		labels = "POST /api/v1/repos/zack/profile/issues/3/labels"
+	)
+
+	tests := []struct {
+		name       string
+		responses  map[string]fakeResponse
+		labels     []string
+		wantRoutes []string
+		wantIDs    []interface{}
+		wantErr    bool
+	}{
+		{
+			name: "single page",
+			responses: map[string]fakeResponse{
+				page1:  giteaLabelsPage(t, 1, "badge", "automated"),
+				labels: {Body: "[]"},
+			},
+			labels:     []string{"automated", "badge"},
+			wantRoutes: []string{page1, labels},
+			wantIDs:    []interface{}{float64(2), float64(1)},
+		},
+		{
+			name: "label on a later page",
+			responses: map[string]fakeResponse{
+				page1:  fullGiteaLabelsPage(t, 1),
+				page2:  giteaLabelsPage(t, 51, "badge"),
+				labels: {Body: "[]"},
+			},
+			labels:     []string{"badge", "label-7"},
+			wantRoutes: []string{page1, page2, labels},
+			wantIDs:    []interface{}{float64(51), float64(7)},
+		},
+		{
+			name: "full last page",
+			responses: map[string]fakeResponse{
+				page1:  fullGiteaLabelsPage(t, 1),
+				page2:  {Body: "[]"},
+				labels: {Body: "[]"},
+			},
+			labels:     []string{"label-50"},
+			wantRoutes: []string{page1, page2, labels},
+			wantIDs:    []interface{}{float64(50)},
+		},
+		{
+			name: "missing label",
+			responses: map[string]fakeResponse{
+				page1: giteaLabelsPage(t, 1, "automated"),
+			},
+			labels:     []string{"badge"},
+			wantRoutes: []string{page1},
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, apiURL := newFakeForgeAPI(t, tt.responses)
+			forge := newGiteaForge(ForgeRepo{Kind: FORGE_GITEA, APIURL: apiURL + "/api/v1", Path: "zack/profile"}, "token", "main")
+
+			err := forge.AddLabels(&ChangeRequest{Number: 3}, tt.labels)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AddLabels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if routes := api.routes(); !reflect.DeepEqual(routes, tt.wantRoutes) {
+				t.Errorf("Requests = %v, want %v", routes, tt.wantRoutes)
+			}
+
+			if !tt.wantErr {
+				if ids := api.lastBody(labels)["labels"]; !reflect.DeepEqual(ids, tt.wantIDs) {
+					t.Errorf("Label IDs = %v, want %v", ids, tt.wantIDs)
+				}
+			}
+		})
+	}
+}
+
+func TestGiteaListChangeRequests(t *testing.T) {
+	pr := func(number int, base, headRepo string) map[string]interface{} {
+		return map[string]interface{}{
+			"number":   number,
+			"html_url": fmt.Sprintf("https://gitea.example.com/zack/profile/pulls/%d", number),
+			"head":     map[string]interface{}{"ref": "update-wren-badge", "sha": "abc", "repo": map[string]string{"full_name": headRepo}},
+			"base":     map[string]string{"ref": base},
+		}
+	}
+
+	fullPage := []map[string]interface{}{}
+	for i := 1; i <= GITEA_PAGE_SIZE; i++ {
+		fullPage = append(fullPage, pr(i, "develop", "zack/profile"))
+	}
+	fullPage[0] = pr(1, "main", "zack/profile")
+	page1, _ := json.Marshal(fullPage)
+	page2, _ := json.Marshal([]map[string]interface{}{pr(51, "main", "bot/profile")})
+
+	_, apiURL := newFakeForgeAPI(t, map[string]fakeResponse{
+		"GET /api/v1/repos/zack/profile/pulls?state=open&limit=50&page=1": {Body: string(page1)},
+		"GET /api/v1/repos/zack/profile/pulls?state=open&limit=50&page=2": {Body: string(page2)},
+	})
+	forge := newGiteaForge(ForgeRepo{Kind: FORGE_GITEA, APIURL: apiURL + "/api/v1", Path: "zack/profile"}, "token", "main")
+
+	crs, err := forge.ListChangeRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*ChangeRequest{
+		{Kind: "Pull Request", Number: 1, Reference: "#1", URL: "https://gitea.example.com/zack/profile/pulls/1",
+			HeadBranch: "update-wren-badge", HeadSHA: "abc", HeadRepo: "zack/profile", SameRepo: true},
+		{Kind: "Pull Request", Number: 51, Reference: "#51", URL: "https://gitea.example.com/zack/profile/pulls/51",
+			HeadBranch: "update-wren-badge", HeadSHA: "abc", HeadRepo: "bot/profile"},
+	}
+	if !reflect.DeepEqual(crs, want) {
+		t.Errorf("ListChangeRequests() = %+v, want %+v", crs, want)
+	}
+}
+
+func TestGiteaMerge(t *testing.T) {
+	const (
+		merge = "POST /api/v1/repos/zack/profile/pulls/3/merge"
+		get   = "GET /api/v1/repos/zack/profile/pulls/3"
+	)
+
+	tests := []struct {
+		name    string
+		pr      string
+		wantSHA string
+	}{
+		{name: "merged", pr: `{"merged": true, "merge_commit_sha": "merge", "head": {"sha": "head"}}`, wantSHA: "merge"},
+		{name: "merged by an old Gitea", pr: `{"merged": true, "head": {"sha": "head"}}`, wantSHA: "head"},
+		{name: "waiting for checks", pr: `{"merged": false, "head": {"sha": "head"}}`, wantSHA: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, apiURL := newFakeForgeAPI(t, map[string]fakeResponse{
+				merge: {Body: ""},
+				get:   {Body: tt.pr},
+			})
+			forge := newGiteaForge(ForgeRepo{Kind: FORGE_GITEA, APIURL: apiURL + "/api/v1", Path: "zack/profile"}, "token", "main")
+
+			sha, err := forge.Merge(&ChangeRequest{Number: 3, HeadSHA: "head"}, "squash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sha != tt.wantSHA {
+				t.Errorf("Merge() = %q, want %q", sha, tt.wantSHA)
+			}
+
+			body := api.lastBody(merge)
+			if body["Do"] != "squash" || body["head_commit_id"] != "head" || body["merge_when_checks_succeed"] != true {
+				t.Errorf("Merge request body = %v", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+)
+
+// GithubForge delivers badge updates as Github Pull Requests
+type GithubForge struct {
+	client *github.Client
+	owner  string
+	repo   string
+	// base is the branch Pull Requests are opened against
+	base string
+}
+
+// newGithubForge wraps an authenticated Github API client for the owner/repo repository, for Pull Requests against base
+func newGithubForge(githubClient *github.Client, owner, repo, base string) *GithubForge {
+	return &GithubForge{client: githubClient, owner: owner, repo: repo, base: base}
+}
+
+// githubChangeRequest converts a Github Pull Request into a ChangeRequest
+func (f *GithubForge) githubChangeRequest(pr *github.PullRequest) *ChangeRequest {
+	return &ChangeRequest{
+		Kind:       "Pull Request",
+		Number:     pr.GetNumber(),
+		Reference:  fmt.Sprintf("#%d", pr.GetNumber()),
+		NodeID:     pr.GetNodeID(),
+		URL:        pr.GetHTMLURL(),
+		HeadBranch: pr.GetHead().GetRef(),
+		HeadSHA:    pr.GetHead().GetSHA(),
+		HeadRepo:   pr.GetHead().GetRepo().GetFullName(),
+		SameRepo:   pr.GetHead().GetRepo().GetFullName() == fmt.Sprintf("%s/%s", f.owner, f.repo),
+	}
+}
+
+// ListChangeRequests lists the open Pull Requests against the base branch
+func (f *GithubForge) ListChangeRequests() ([]*ChangeRequest, error) {
+	crs := []*ChangeRequest{}
+
+	opts := &github.PullRequestListOptions{
+		State:       "open",
+		Base:        f.base,
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	for {
+		prs, resp, err := f.client.PullRequests.List(context.Background(), f.owner, f.repo, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pr := range prs {
+			crs = append(crs, f.githubChangeRequest(pr))
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	return crs, nil
+}
+
+// EnsureFork forks the repository into the FORK_NAMESPACE organization, or the authenticated user's account. Github returns
+// the existing fork when there already is one, and otherwise copies the repository into the new fork in the background, so
+// this waits until the fork has branches before returning it
+func (f *GithubForge) EnsureFork() (*Fork, error) {
+	ctx := context.Background()
+
+	repo, _, err := f.client.Repositories.CreateFork(ctx, f.owner, f.repo, &github.RepositoryCreateForkOptions{
+		Organization: os.Getenv("FORK_NAMESPACE"),
+	})
+	// Github answers 202 Accepted, which go-github reports as an error alongside the fork
+	if _, accepted := err.(*github.AcceptedError); err != nil && !accepted {
+		return nil, err
+	}
+
+	fork := &Fork{
+		ID:       repo.GetFullName(),
+		Owner:    repo.GetOwner().GetLogin(),
+		CloneURL: repo.GetCloneURL(),
+	}
+
+	for attempt := 0; attempt < FORK_POLL_ATTEMPTS; attempt++ {
+		branches, _, err := f.client.Repositories.ListBranches(ctx, fork.Owner, repo.GetName(), &github.BranchListOptions{
+			ListOptions: github.ListOptions{PerPage: 1},
+		})
+		if err == nil && len(branches) > 0 {
+			return fork, nil
+		}
+		time.Sleep(FORK_POLL_INTERVAL)
+	}
+
+	return nil, fmt.Errorf("Timed out waiting for Github to finish creating the fork %s", fork.ID)
+}
+
+// OpenChangeRequest opens a Pull Request of branch against the base branch. A branch in a fork is given to Github as
+// owner:branch
+func (f *GithubForge) OpenChangeRequest(fork *Fork, branch, title, body string) (*ChangeRequest, error) {
+	head := branch
+	if fork != nil {
+		head = fork.Owner + ":" + branch
+	}
+
+	// Configure pull request options that the Github client accepts when making calls to open new pull requests
+	newPR := &github.NewPullRequest{
+		Title:               github.String(title),
+		Head:                github.String(head),
+		Base:                github.String(f.base),
+		Body:                github.String(body),
+		MaintainerCanModify: github.Bool(true),
+	}
+
+	// Make a pull request via the Github API
+	pr, _, err := f.client.PullRequests.Create(context.Background(), f.owner, f.repo, newPR)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.githubChangeRequest(pr), nil
+}
+
+// UpdateChangeRequest replaces the title and body of a Pull Request
+func (f *GithubForge) UpdateChangeRequest(cr *ChangeRequest, title, body string) (*ChangeRequest, error) {
+	pr, _, err := f.client.PullRequests.Edit(context.Background(), f.owner, f.repo, cr.Number, &github.PullRequest{
+		Title: github.String(title),
+		Body:  github.String(body),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return f.githubChangeRequest(pr), nil
+}
+
+// Comment comments on a Pull Request, which Github treats as an issue
+func (f *GithubForge) Comment(cr *ChangeRequest, body string) error {
+	_, _, err := f.client.Issues.CreateComment(context.Background(), f.owner, f.repo, cr.Number, &github.IssueComment{
+		Body: github.String(body),
+	})
+	return err
+}
+
+// Close closes a Pull Request without merging it
+func (f *GithubForge) Close(cr *ChangeRequest) error {
+	_, _, err := f.client.PullRequests.Edit(context.Background(), f.owner, f.repo, cr.Number, &github.PullRequest{
+		State: github.String("closed"),
+	})
+	return err
+}
+
+// DeleteBranch deletes a branch of the fork, or of the repository itself
+func (f *GithubForge) DeleteBranch(fork *Fork, branch string) error {
+	owner, repo := f.owner, f.repo
+	if fork != nil {
+		forkRepo := ForgeRepo{Path: fork.ID}
+		owner, repo = forkRepo.Owner(), forkRepo.Name()
+	}
+
+	_, err := f.client.Git.DeleteRef(context.Background(), owner, repo, "heads/"+branch)
+	return err
+}
+
+// RequestReviewers asks users, or org/team-slug teams, to review a Pull Request
+func (f *GithubForge) RequestReviewers(cr *ChangeRequest, reviewers []string) error {
+	request := github.ReviewersRequest{}
+	for _, reviewer := range reviewers {
+		if parts := strings.SplitN(reviewer, "/", 2); len(parts) == 2 {
+			request.TeamReviewers = append(request.TeamReviewers, parts[1])
+			continue
+		}
+		request.Reviewers = append(request.Reviewers, reviewer)
+	}
+
+	_, _, err := f.client.PullRequests.RequestReviewers(context.Background(), f.owner, f.repo, cr.Number, request)
+	return err
+}
+
+// AddLabels adds labels to a Pull Request, which Github treats as an issue
+func (f *GithubForge) AddLabels(cr *ChangeRequest, labels []string) error {
+	_, _, err := f.client.Issues.AddLabelsToIssue(context.Background(), f.owner, f.repo, cr.Number, labels)
+	return err
+}
+
+// AddAssignees assigns users to a Pull Request
+func (f *GithubForge) AddAssignees(cr *ChangeRequest, assignees []string) error {
+	_, _, err := f.client.Issues.AddAssignees(context.Background(), f.owner, f.repo, cr.Number, assignees)
+	return err
+}
+
+// Merge merges the Pull Request right away if Github reports it can be merged cleanly. Otherwise, such as while
+// required status checks are still running, it enables Github's auto-merge so the Pull Request merges once they pass.
+// It returns the commit the Pull Request was merged as, which is empty when auto-merge was enabled instead
+func (f *GithubForge) Merge(cr *ChangeRequest, method string) (string, error) {
+	ctx := context.Background()
+
+	for attempt := 0; attempt < MERGEABLE_POLL_ATTEMPTS; attempt++ {
+		latest, _, err := f.client.PullRequests.Get(ctx, f.owner, f.repo, cr.Number)
+		if err != nil {
+			return "", err
+		}
+
+		if latest.Mergeable == nil {
+			time.Sleep(MERGEABLE_POLL_INTERVAL)
+			continue
+		}
+
+		if latest.GetMergeable() && latest.GetMergeableState() == "clean" {
+			result, _, err := f.client.PullRequests.Merge(ctx, f.owner, f.repo, cr.Number, "", &github.PullRequestOptions{
+				MergeMethod: method,
+				SHA:         latest.GetHead().GetSHA(),
+			})
+			if err != nil {
+				return "", err
+			}
+			return result.GetSHA(), nil
+		}
+
+		break
+	}
+
+	return "", f.enableAutoMerge(cr, method)
+}
+
+// graphqlURL returns the address of the GraphQL API alongside the client's REST API. On github.com that is
+// https://api.github.com/graphql, but Github Enterprise serves its REST API from /api/v3/ and GraphQL from /api/graphql
+func (f *GithubForge) graphqlURL() string {
+	endpoint := *f.client.BaseURL
+	if strings.HasSuffix(endpoint.Path, "/api/v3/") {
+		endpoint.Path = strings.TrimSuffix(endpoint.Path, "v3/") + "graphql"
+		return endpoint.String()
+	}
+	endpoint.Path += "graphql"
+	return endpoint.String()
+}
+
+// enableAutoMerge turns on Github's auto-merge for the Pull Request. This is only available through the GraphQL API
+func (f *GithubForge) enableAutoMerge(cr *ChangeRequest, method string) error {
+	query := map[string]interface{}{
+		"query": `mutation($id: ID!, $method: PullRequestMergeMethod!) {
+  enablePullRequestAutoMerge(input: {pullRequestId: $id, mergeMethod: $method}) { clientMutationId }
+}`,
+		"variables": map[string]string{
+			"id":     cr.NodeID,
+			"method": strings.ToUpper(method),
+		},
+	}
+
+	req, err := f.client.NewRequest("POST", f.graphqlURL(), query)
+	if err != nil {
+		return err
+	}
+
+	var response struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+
+	if _, err := f.client.Do(context.Background(), req, &response); err != nil {
+		return err
+	}
+
+	if len(response.Errors) > 0 {
+		return fmt.Errorf("Error enabling auto-merge on %s: %s", cr.URL, response.Errors[0].Message)
+	}
+
+	fmt.Printf("Enabled auto-merge on Pull Request: %s\n", cr.URL)
+	return nil
+}
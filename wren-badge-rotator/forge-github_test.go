@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-github/v32/github"
+)
+
+func TestGithubEnableAutoMergeGraphQLEndpoint(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		apiPath string
+		route   string
+	}{
+		{"github.com", "/", "POST /graphql"},
+		{"Github Enterprise", "/api/v3/", "POST /api/graphql"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			api, apiURL := newFakeForgeAPI(t, map[string]fakeResponse{
+				test.route: {Body: `{"data": {"enablePullRequestAutoMerge": {"clientMutationId": null}}}`},
+			})
+
+			client := github.NewClient(nil)
+			client.BaseURL, _ = url.Parse(apiURL + test.apiPath)
+			forge := newGithubForge(client, "zackproser", "zackproser", "main")
+
+			cr := &ChangeRequest{NodeID: "PR_kwDOA", URL: "https://example.com/pull/1"}
+			if err := forge.enableAutoMerge(cr, "squash"); err != nil {
+				t.Fatal(err)
+			}
+			if routes := api.routes(); !reflect.DeepEqual(routes, []string{test.route}) {
+				t.Errorf("enableAutoMerge() requested %v, want %s", routes, test.route)
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GitLabForge delivers badge updates as GitLab Merge Requests, through the GitLab REST API
+type GitLabForge struct {
+	api *forgeClient
+	// project is the URL-encoded group/project path, which the API accepts in place of the project's numeric ID
+	project string
+	// base is the branch Merge Requests target
+	base string
+}
+
+// gitlabMergeRequest is the part of the GitLab API's Merge Request representation this tool uses
+type gitlabMergeRequest struct {
+	IID             int    `json:"iid"`
+	WebURL          string `json:"web_url"`
+	State           string `json:"state"`
+	SourceBranch    string `json:"source_branch"`
+	SHA             string `json:"sha"`
+	SourceProjectID int    `json:"source_project_id"`
+	TargetProjectID int    `json:"target_project_id"`
+	MergeStatus     string `json:"merge_status"`
+	MergeCommitSHA  string `json:"merge_commit_sha"`
+	SquashCommitSHA string `json:"squash_commit_sha"`
+	HeadPipeline    *struct {
+		Status string `json:"status"`
+	} `json:"head_pipeline"`
+}
+
+// gitlabProject is the part of the GitLab API's project representation this tool uses
+type gitlabProject struct {
+	ID            int    `json:"id"`
+	HTTPURLToRepo string `json:"http_url_to_repo"`
+	ImportStatus  string `json:"import_status"`
+	Namespace     struct {
+		FullPath string `json:"full_path"`
+	} `json:"namespace"`
+}
+
+// newGitLabForge creates a GitLab API client for the repository, authenticating with a personal, group or project access token,
+// for Merge Requests targeting base
+func newGitLabForge(repo ForgeRepo, token, base string) *GitLabForge {
+	return &GitLabForge{
+		api:     newForgeClient(repo.APIURL, "PRIVATE-TOKEN", token),
+		project: url.PathEscape(repo.Path),
+		base:    base,
+	}
+}
+
+// mergeRequestPath is the API path of a Merge Request
+func (f *GitLabForge) mergeRequestPath(cr *ChangeRequest) string {
+	return fmt.Sprintf("projects/%s/merge_requests/%d", f.project, cr.Number)
+}
+
+// gitlabChangeRequest converts a GitLab Merge Request into a ChangeRequest
+func gitlabChangeRequest(mr gitlabMergeRequest) *ChangeRequest {
+	return &ChangeRequest{
+		Kind:       "Merge Request",
+		Number:     mr.IID,
+		Reference:  fmt.Sprintf("!%d", mr.IID),
+		URL:        mr.WebURL,
+		HeadBranch: mr.SourceBranch,
+		HeadSHA:    mr.SHA,
+		HeadRepo:   strconv.Itoa(mr.SourceProjectID),
+		SameRepo:   mr.SourceProjectID == mr.TargetProjectID,
+	}
+}
+
+// ListChangeRequests lists the open Merge Requests targeting the base branch
+func (f *GitLabForge) ListChangeRequests() ([]*ChangeRequest, error) {
+	crs := []*ChangeRequest{}
+
+	for page := "1"; page != ""; {
+		mrs := []gitlabMergeRequest{}
+		resp, err := f.api.do("GET", fmt.Sprintf("projects/%s/merge_requests?state=opened&target_branch=%s&per_page=100&page=%s",
+			f.project, url.QueryEscape(f.base), page), nil, &mrs)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, mr := range mrs {
+			crs = append(crs, gitlabChangeRequest(mr))
+		}
+
+		page = resp.Header.Get("X-Next-Page")
+	}
+
+	return crs, nil
+}
+
+// EnsureFork forks the project into the FORK_NAMESPACE group, or the authenticated user's namespace, unless the project has
+// already been forked there. GitLab copies the repository into a new fork in the background, so this waits for the import
+// to finish before returning the fork
+func (f *GitLabForge) EnsureFork() (*Fork, error) {
+	namespace := os.Getenv("FORK_NAMESPACE")
+	if namespace == "" {
+		user := struct {
+			Username string `json:"username"`
+		}{}
+		if _, err := f.api.do("GET", "user", nil, &user); err != nil {
+			return nil, err
+		}
+		namespace = user.Username
+	}
+
+	var fork *gitlabProject
+	for page := "1"; page != "" && fork == nil; {
+		forks := []gitlabProject{}
+		resp, err := f.api.do("GET", fmt.Sprintf("projects/%s/forks?per_page=100&page=%s", f.project, page), nil, &forks)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range forks {
+			if strings.EqualFold(forks[i].Namespace.FullPath, namespace) {
+				fork = &forks[i]
+				break
+			}
+		}
+
+		page = resp.Header.Get("X-Next-Page")
+	}
+
+	if fork == nil {
+		fork = &gitlabProject{}
+		_, err := f.api.do("POST", fmt.Sprintf("projects/%s/fork", f.project), map[string]string{"namespace_path": namespace}, fork)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Forked %s into %s\n", f.project, namespace)
+	}
+
+	for attempt := 0; fork.ImportStatus == "scheduled" || fork.ImportStatus == "started"; attempt++ {
+		if attempt == FORK_POLL_ATTEMPTS {
+			return nil, fmt.Errorf("Timed out waiting for GitLab to finish creating the fork of %s in %s", f.project, namespace)
+		}
+		time.Sleep(FORK_POLL_INTERVAL)
+		if _, err := f.api.do("GET", fmt.Sprintf("projects/%d", fork.ID), nil, fork); err != nil {
+			return nil, err
+		}
+	}
+
+	if fork.ImportStatus == "failed" {
+		return nil, fmt.Errorf("GitLab failed to create the fork of %s in %s", f.project, namespace)
+	}
+
+	return &Fork{
+		ID:       strconv.Itoa(fork.ID),
+		Owner:    fork.Namespace.FullPath,
+		CloneURL: fork.HTTPURLToRepo,
+	}, nil
+}
+
+// OpenChangeRequest opens a Merge Request of branch against the base branch. A Merge Request from a fork is opened on the
+// fork, targeting the project by its numeric ID
+func (f *GitLabForge) OpenChangeRequest(fork *Fork, branch, title, body string) (*ChangeRequest, error) {
+	source := f.project
+	options := map[string]interface{}{
+		"source_branch":        branch,
+		"target_branch":        f.base,
+		"title":                title,
+		"description":          body,
+		"remove_source_branch": true,
+	}
+
+	if fork != nil {
+		target := gitlabProject{}
+		if _, err := f.api.do("GET", "projects/"+f.project, nil, &target); err != nil {
+			return nil, err
+		}
+		source = fork.ID
+		options["target_project_id"] = target.ID
+	}
+
+	mr := gitlabMergeRequest{}
+	_, err := f.api.do("POST", fmt.Sprintf("projects/%s/merge_requests", source), options, &mr)
+	if err != nil {
+		return nil, err
+	}
+
+	return gitlabChangeRequest(mr), nil
+}
+
+// UpdateChangeRequest replaces the title and description of a Merge Request
+func (f *GitLabForge) UpdateChangeRequest(cr *ChangeRequest, title, body string) (*ChangeRequest, error) {
+	mr := gitlabMergeRequest{}
+	_, err := f.api.do("PUT", f.mergeRequestPath(cr), map[string]string{
+		"title":       title,
+		"description": body,
+	}, &mr)
+	if err != nil {
+		return nil, err
+	}
+
+	return gitlabChangeRequest(mr), nil
+}
+
+// Comment adds a note to a Merge Request
+func (f *GitLabForge) Comment(cr *ChangeRequest, body string) error {
+	_, err := f.api.do("POST", f.mergeRequestPath(cr)+"/notes", map[string]string{"body": body}, nil)
+	return err
+}
+
+// Close closes a Merge Request without merging it
+func (f *GitLabForge) Close(cr *ChangeRequest) error {
+	_, err := f.api.do("PUT", f.mergeRequestPath(cr), map[string]string{"state_event": "close"}, nil)
+	return err
+}
+
+// DeleteBranch deletes a branch of the fork, or of the project itself
+func (f *GitLabForge) DeleteBranch(fork *Fork, branch string) error {
+	project := f.project
+	if fork != nil {
+		project = fork.ID
+	}
+
+	_, err := f.api.do("DELETE", fmt.Sprintf("projects/%s/repository/branches/%s", project, url.PathEscape(branch)), nil, nil)
+	return err
+}
+
+// RequestReviewers sets the Merge Request's reviewers. GitLab has no team reviewers
+func (f *GitLabForge) RequestReviewers(cr *ChangeRequest, reviewers []string) error {
+	for _, reviewer := range reviewers {
+		if strings.Contains(reviewer, "/") {
+			return fmt.Errorf("GitLab Merge Requests can't be reviewed by teams, got: %s", reviewer)
+		}
+	}
+
+	ids, err := f.userIDs(reviewers)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.api.do("PUT", f.mergeRequestPath(cr), map[string]interface{}{"reviewer_ids": ids}, nil)
+	return err
+}
+
+// AddLabels adds labels to a Merge Request
+func (f *GitLabForge) AddLabels(cr *ChangeRequest, labels []string) error {
+	_, err := f.api.do("PUT", f.mergeRequestPath(cr), map[string]string{"add_labels": strings.Join(labels, ",")}, nil)
+	return err
+}
+
+// AddAssignees sets the Merge Request's assignees
+func (f *GitLabForge) AddAssignees(cr *ChangeRequest, assignees []string) error {
+	ids, err := f.userIDs(assignees)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.api.do("PUT", f.mergeRequestPath(cr), map[string]interface{}{"assignee_ids": ids}, nil)
+	return err
+}
+
+// userIDs looks up the IDs of GitLab users by username, which is how GitLab assigns reviewers and assignees
+func (f *GitLabForge) userIDs(usernames []string) ([]int, error) {
+	ids := []int{}
+	for _, username := range usernames {
+		users := []struct {
+			ID int `json:"id"`
+		}{}
+		if _, err := f.api.do("GET", "users?username="+url.QueryEscape(username), nil, &users); err != nil {
+			return nil, err
+		}
+		if len(users) == 0 {
+			return nil, fmt.Errorf("No GitLab user named %s", username)
+		}
+		ids = append(ids, users[0].ID)
+	}
+	return ids, nil
+}
+
+// Merge waits for GitLab to work out whether the Merge Request can be merged, then merges it. While its pipeline is still
+// running, the Merge Request is set to merge when the pipeline succeeds instead. It returns the commit the Merge Request landed
+// on the target branch as, which is empty when it was set to merge later
+func (f *GitLabForge) Merge(cr *ChangeRequest, method string) (string, error) {
+	if method == "rebase" {
+		return "", errors.New("GitLab Merge Requests are merged with the project's merge method, rebase must be configured on the project itself")
+	}
+
+	mr := gitlabMergeRequest{}
+	for attempt := 0; attempt < MERGEABLE_POLL_ATTEMPTS; attempt++ {
+		if _, err := f.api.do("GET", f.mergeRequestPath(cr), nil, &mr); err != nil {
+			return "", err
+		}
+
+		if mr.MergeStatus != "unchecked" && mr.MergeStatus != "checking" {
+			break
+		}
+
+		time.Sleep(MERGEABLE_POLL_INTERVAL)
+	}
+
+	if mr.MergeStatus != "can_be_merged" {
+		return "", fmt.Errorf("GitLab reports %s can't be merged: %s", cr.URL, mr.MergeStatus)
+	}
+
+	pipelineRunning := false
+	if mr.HeadPipeline != nil {
+		switch mr.HeadPipeline.Status {
+		case "created", "waiting_for_resource", "preparing", "pending", "running", "scheduled":
+			pipelineRunning = true
+		}
+	}
+
+	merged := gitlabMergeRequest{}
+	_, err := f.api.do("PUT", f.mergeRequestPath(cr)+"/merge", map[string]interface{}{
+		"squash":                       method == "squash",
+		"sha":                          mr.SHA,
+		"merge_when_pipeline_succeeds": pipelineRunning,
+	}, &merged)
+	if err != nil {
+		return "", err
+	}
+
+	if merged.State != "merged" {
+		fmt.Printf("Set Merge Request %s to merge when its pipeline succeeds\n", cr.URL)
+		return "", nil
+	}
+
+	// Projects that merge with a merge commit record it, fast-forward projects record the squashed commit when squashing, and
+	// otherwise the branch's own head commit is what landed
+	switch {
+	case merged.MergeCommitSHA != "":
+		return merged.MergeCommitSHA, nil
+	case merged.SquashCommitSHA != "":
+		return merged.SquashCommitSHA, nil
+	default:
+		return merged.SHA, nil
+	}
+}
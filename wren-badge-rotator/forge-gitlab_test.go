@@ -0,0 +1,188 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGitLabOpenChangeRequest(t *testing.T) {
+	const (
+		project       = "GET /api/v4/projects/group%2Fprofile"
+		projectMRs    = "POST /api/v4/projects/group%2Fprofile/merge_requests"
+		forkMRs       = "POST /api/v4/projects/42/merge_requests"
+		createdMR     = `{"iid": 5, "web_url": "https://gitlab.example.com/group/profile/-/merge_requests/5", "source_branch": "update-wren-badge", "sha": "abc", "source_project_id": 7, "target_project_id": 7}`
+		createdForkMR = `{"iid": 5, "web_url": "https://gitlab.example.com/group/profile/-/merge_requests/5", "source_branch": "update-wren-badge", "sha": "abc", "source_project_id": 42, "target_project_id": 7}`
+	)
+
+	tests := []struct {
+		name       string
+		fork       *Fork
+		responses  map[string]fakeResponse
+		wantRoutes []string
+		wantBody   map[string]interface{}
+		want       *ChangeRequest
+	}{
+		{
+			name:       "branch in the project",
+			responses:  map[string]fakeResponse{projectMRs: {Body: createdMR}},
+			wantRoutes: []string{projectMRs},
+			wantBody: map[string]interface{}{
+				"source_branch":        "update-wren-badge",
+				"target_branch":        "main",
+				"title":                "Update badge",
+				"description":          "New badge",
+				"remove_source_branch": true,
+			},
+			want: &ChangeRequest{Kind: "Merge Request", Number: 5, Reference: "!5",
+				URL:        "https://gitlab.example.com/group/profile/-/merge_requests/5",
+				HeadBranch: "update-wren-badge", HeadSHA: "abc", HeadRepo: "7", SameRepo: true},
+		},
+		{
+			name: "branch in a fork",
+			fork: &Fork{ID: "42", Owner: "bot"},
+			responses: map[string]fakeResponse{
+				project: {Body: `{"id": 7}`},
+				forkMRs: {Body: createdForkMR},
+			},
+			wantRoutes: []string{project, forkMRs},
+			wantBody: map[string]interface{}{
+				"source_branch":        "update-wren-badge",
+				"target_branch":        "main",
+				"title":                "Update badge",
+				"description":          "New badge",
+				"remove_source_branch": true,
+				"target_project_id":    float64(7),
+			},
+			want: &ChangeRequest{Kind: "Merge Request", Number: 5, Reference: "!5",
+				URL:        "https://gitlab.example.com/group/profile/-/merge_requests/5",
+				HeadBranch: "update-wren-badge", HeadSHA: "abc", HeadRepo: "42"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, apiURL := newFakeForgeAPI(t, tt.responses)
+			forge := newGitLabForge(ForgeRepo{Kind: FORGE_GITLAB, APIURL: apiURL + "/api/v4", Path: "group/profile"}, "token", "main")
+
+			cr, err := forge.OpenChangeRequest(tt.fork, "update-wren-badge", "Update badge", "New badge")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routes := api.routes()
+			if !reflect.DeepEqual(routes, tt.wantRoutes) {
+				t.Errorf("Requests = %v, want %v", routes, tt.wantRoutes)
+			}
+			if body := api.lastBody(routes[len(routes)-1]); !reflect.DeepEqual(body, tt.wantBody) {
+				t.Errorf("Merge Request options = %v, want %v", body, tt.wantBody)
+			}
+			if !reflect.DeepEqual(cr, tt.want) {
+				t.Errorf("OpenChangeRequest() = %+v, want %+v", cr, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitLabListChangeRequests(t *testing.T) {
+	_, apiURL := newFakeForgeAPI(t, map[string]fakeResponse{
+		"GET /api/v4/projects/group%2Fprofile/merge_requests?state=opened&target_branch=main&per_page=100&page=1": {
+			Header: map[string]string{"X-Next-Page": "2"},
+			Body:   `[{"iid": 1, "source_branch": "update-wren-badge", "source_project_id": 7, "target_project_id": 7}]`,
+		},
+		"GET /api/v4/projects/group%2Fprofile/merge_requests?state=opened&target_branch=main&per_page=100&page=2": {
+			Body: `[{"iid": 2, "source_branch": "update-wren-badge", "source_project_id": 42, "target_project_id": 7}]`,
+		},
+	})
+	forge := newGitLabForge(ForgeRepo{Kind: FORGE_GITLAB, APIURL: apiURL + "/api/v4", Path: "group/profile"}, "token", "main")
+
+	crs, err := forge.ListChangeRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*ChangeRequest{
+		{Kind: "Merge Request", Number: 1, Reference: "!1", HeadBranch: "update-wren-badge", HeadRepo: "7", SameRepo: true},
+		{Kind: "Merge Request", Number: 2, Reference: "!2", HeadBranch: "update-wren-badge", HeadRepo: "42"},
+	}
+	if !reflect.DeepEqual(crs, want) {
+		t.Errorf("ListChangeRequests() = %+v, want %+v", crs, want)
+	}
+}
+
+func TestGitLabMerge(t *testing.T) {
+	const (
+		get   = "GET /api/v4/projects/group%2Fprofile/merge_requests/5"
+		merge = "PUT /api/v4/projects/group%2Fprofile/merge_requests/5/merge"
+	)
+
+	tests := []struct {
+		name             string
+		mr               string
+		merged           string
+		method           string
+		wantSHA          string
+		wantWhenPipeline bool
+		wantErr          bool
+	}{
+		{
+			name:    "merge commit",
+			mr:      `{"merge_status": "can_be_merged", "sha": "head"}`,
+			merged:  `{"state": "merged", "sha": "head", "merge_commit_sha": "merge"}`,
+			method:  "merge",
+			wantSHA: "merge",
+		},
+		{
+			name:    "squashed into a fast-forward project",
+			mr:      `{"merge_status": "can_be_merged", "sha": "head"}`,
+			merged:  `{"state": "merged", "sha": "head", "squash_commit_sha": "squash"}`,
+			method:  "squash",
+			wantSHA: "squash",
+		},
+		{
+			name:             "pipeline running",
+			mr:               `{"merge_status": "can_be_merged", "sha": "head", "head_pipeline": {"status": "running"}}`,
+			merged:           `{"state": "opened", "sha": "head"}`,
+			method:           "merge",
+			wantSHA:          "",
+			wantWhenPipeline: true,
+		},
+		{
+			name:    "conflicts",
+			mr:      `{"merge_status": "cannot_be_merged", "sha": "head"}`,
+			method:  "merge",
+			wantErr: true,
+		},
+		{
+			name:    "rebase",
+			method:  "rebase",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, apiURL := newFakeForgeAPI(t, map[string]fakeResponse{
+				get:   {Body: tt.mr},
+				merge: {Body: tt.merged},
+			})
+			forge := newGitLabForge(ForgeRepo{Kind: FORGE_GITLAB, APIURL: apiURL + "/api/v4", Path: "group/profile"}, "token", "main")
+
+			sha, err := forge.Merge(&ChangeRequest{Number: 5}, tt.method)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Merge() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if sha != tt.wantSHA {
+				t.Errorf("Merge() = %q, want %q", sha, tt.wantSHA)
+			}
+
+			body := api.lastBody(merge)
+			if body["sha"] != "head" || body["squash"] != (tt.method == "squash") || body["merge_when_pipeline_succeeds"] != tt.wantWhenPipeline {
+				t.Errorf("Merge options = %v", body)
+			}
+		})
+	}
+}
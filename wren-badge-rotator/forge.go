@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// The forges a profile repository can be hosted on
+	FORGE_GITHUB = "github"
+	FORGE_GITLAB = "gitlab"
+	FORGE_GITEA  = "gitea"
+	// FORGE_HTTP_TIMEOUT bounds every request made to the GitLab and Gitea APIs
+	FORGE_HTTP_TIMEOUT = 30 * time.Second
+	// FORK_POLL_ATTEMPTS and FORK_POLL_INTERVAL bound how long to wait for a new fork to be ready to push to, since Github and
+	// GitLab copy the repository into it asynchronously
+	FORK_POLL_ATTEMPTS = 20
+	FORK_POLL_INTERVAL = 3 * time.Second
+)
+
+// ChangeRequest is a forge's proposal to merge the badge branch into the base branch: a Pull Request on Github and Gitea,
+// or a Merge Request on GitLab
+type ChangeRequest struct {
+	// Kind is what the forge calls a change request, for logs
+	Kind string
+	// Number identifies the change request within its repository
+	Number int
+	// Reference is how the forge links to the change request in comments, such as #12 or !12
+	Reference string
+	// NodeID is the change request's global ID, which Github's GraphQL API needs to enable auto-merge
+	NodeID string
+	// URL is the change request's web page
+	URL string
+	// HeadBranch and HeadSHA are the branch being merged and the commit at its tip
+	HeadBranch string
+	HeadSHA    string
+	// HeadRepo identifies the repository the head branch lives in, the same way Fork.ID does
+	HeadRepo string
+	// SameRepo is true when the head branch lives in the repository itself, rather than in a fork
+	SameRepo bool
+}
+
+// Forge is the API of the service hosting the profile repository, covering everything needed to deliver the badge update
+// as a change request against the base branch
+type Forge interface {
+	// ListChangeRequests lists the open change requests targeting the base branch
+	ListChangeRequests() ([]*ChangeRequest, error)
+	// EnsureFork forks the repository into FORK_NAMESPACE, or the authenticated account when it is unset, unless it has
+	// already been forked there, and returns the fork once it can be pushed to
+	EnsureFork() (*Fork, error)
+	// OpenChangeRequest opens a change request of branch against the base branch. The branch lives in fork, or in the
+	// repository itself when fork is nil
+	OpenChangeRequest(fork *Fork, branch, title, body string) (*ChangeRequest, error)
+	// UpdateChangeRequest replaces the title and body of an open change request
+	UpdateChangeRequest(cr *ChangeRequest, title, body string) (*ChangeRequest, error)
+	// Comment adds a comment to a change request
+	Comment(cr *ChangeRequest, body string) error
+	// Close closes a change request without merging it
+	Close(cr *ChangeRequest) error
+	// DeleteBranch deletes a branch of fork, or of the repository itself when fork is nil
+	DeleteBranch(fork *Fork, branch string) error
+	// RequestReviewers asks users, or org/team teams, to review a change request
+	RequestReviewers(cr *ChangeRequest, reviewers []string) error
+	// AddLabels adds existing labels, by name, to a change request
+	AddLabels(cr *ChangeRequest, labels []string) error
+	// AddAssignees assigns users to a change request
+	AddAssignees(cr *ChangeRequest, assignees []string) error
+	// Merge merges a change request with the given method (merge, squash or rebase) as soon as the forge allows. It returns
+	// the commit the change request landed on the base branch as when it was merged immediately, such as the squashed commit,
+	// or an empty SHA when it was scheduled to merge once its checks pass
+	Merge(cr *ChangeRequest, method string) (string, error)
+}
+
+// Fork is a fork of the repository that badge branches are pushed to, for credentials that can only read the repository itself
+type Fork struct {
+	// ID identifies the fork to the forge's API: its owner/name on Github and Gitea, or its numeric project ID on GitLab
+	ID string
+	// Owner is the user, organization or group the fork belongs to
+	Owner string
+	// CloneURL is the fork's https clone URL, which badge branches are pushed to
+	CloneURL string
+}
+
+// ForgeRepo identifies a repository on a forge
+type ForgeRepo struct {
+	// Kind is one of the FORGE_ constants
+	Kind string
+	// APIURL is the root of the forge's REST API. It is empty for github.com, which go-github already knows
+	APIURL string
+	// Path is the repository's owner/name, or its full group/subgroup/name path on GitLab
+	Path string
+	// WebURL is the scheme and host the forge's web pages are served from
+	WebURL string
+	// InstallationID is the Github App installation covering a Github repository, or 0 when it is looked up
+	InstallationID int64
+}
+
+// Owner is the user or group the repository belongs to
+func (r ForgeRepo) Owner() string {
+	return r.Path[:strings.LastIndex(r.Path, "/")]
+}
+
+// Name is the repository's name, without its owner
+func (r ForgeRepo) Name() string {
+	return r.Path[strings.LastIndex(r.Path, "/")+1:]
+}
+
+// RawURL is the address the forge serves the contents of filePath on branch at, which is how images on a branch other than the
+// one being viewed are embedded in its markdown
+func (r ForgeRepo) RawURL(branch, filePath string) string {
+	escaped := []string{}
+	for _, part := range strings.Split(path.Join(branch, filePath), "/") {
+		escaped = append(escaped, url.PathEscape(part))
+	}
+	ref := strings.Join(escaped, "/")
+
+	switch {
+	case r.Kind == FORGE_GITHUB && r.WebURL == "https://github.com":
+		return fmt.Sprintf("https://raw.githubusercontent.com/%s/%s", r.Path, ref)
+	case r.Kind == FORGE_GITLAB:
+		return fmt.Sprintf("%s/%s/-/raw/%s", r.WebURL, r.Path, ref)
+	case r.Kind == FORGE_GITEA:
+		return fmt.Sprintf("%s/%s/raw/branch/%s", r.WebURL, r.Path, ref)
+	default:
+		// Github Enterprise Server
+		return fmt.Sprintf("%s/%s/raw/%s", r.WebURL, r.Path, ref)
+	}
+}
+
+// parseForgeRepo works out which forge hosts the repository at repoURL, and where its API lives. kind names the forge for
+// self-hosted instances whose hostname doesn't give it away, and apiURL overrides the API's location, when they are set
+func parseForgeRepo(repoURL, kind, apiURL string) (ForgeRepo, error) {
+	parsed, err := url.Parse(repoURL)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return ForgeRepo{}, fmt.Errorf("The repository URL must be an http(s) URL, got: %s", repoURL)
+	}
+
+	repo := ForgeRepo{
+		Kind:   kind,
+		APIURL: apiURL,
+		Path:   strings.Trim(strings.TrimSuffix(parsed.Path, ".git"), "/"),
+		WebURL: parsed.Scheme + "://" + parsed.Host,
+	}
+
+	host := strings.ToLower(parsed.Hostname())
+	if repo.Kind == "" {
+		switch {
+		case host == "github.com":
+			repo.Kind = FORGE_GITHUB
+		case host == "gitlab.com" || strings.Contains(host, "gitlab"):
+			repo.Kind = FORGE_GITLAB
+		case host == "codeberg.org" || strings.Contains(host, "gitea"):
+			repo.Kind = FORGE_GITEA
+		default:
+			return ForgeRepo{}, fmt.Errorf("Can't tell which forge hosts %s, set FORGE, or the target's forge, to %s, %s or %s",
+				repoURL, FORGE_GITHUB, FORGE_GITLAB, FORGE_GITEA)
+		}
+	}
+
+	parts := strings.Split(repo.Path, "/")
+	switch repo.Kind {
+	case FORGE_GITHUB, FORGE_GITEA:
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return ForgeRepo{}, fmt.Errorf("%s repository URLs must be of the form https://host/owner/repo, got: %s", repo.Kind, repoURL)
+		}
+	case FORGE_GITLAB:
+		if len(parts) < 2 || strings.Contains(repo.Path, "//") {
+			return ForgeRepo{}, fmt.Errorf("GitLab repository URLs must be of the form https://host/group/project, got: %s", repoURL)
+		}
+	default:
+		return ForgeRepo{}, fmt.Errorf("The forge must be %s, %s or %s, got: %s", FORGE_GITHUB, FORGE_GITLAB, FORGE_GITEA, repo.Kind)
+	}
+
+	if repo.APIURL == "" {
+		root := repo.WebURL
+		switch {
+		case repo.Kind == FORGE_GITHUB && host != "github.com":
+			// Github Enterprise Server
+			repo.APIURL = root + "/api/v3/"
+		case repo.Kind == FORGE_GITLAB:
+			repo.APIURL = root + "/api/v4/"
+		case repo.Kind == FORGE_GITEA:
+			repo.APIURL = root + "/api/v1/"
+		}
+	}
+
+	return repo, nil
+}
+
+// forgeCredentials returns the credentials used to push to the repository and call its forge's API. Github uses a Github App
+// installation token or a personal access token, as getGithubCredentials decides, while GitLab and Gitea use the access token
+// in GITLAB_TOKEN or GITEA_TOKEN. The token is empty when none is configured
+func forgeCredentials(repo ForgeRepo) (ForgeCredentials, error) {
+	switch repo.Kind {
+	case FORGE_GITLAB:
+		// GitLab accepts any username alongside an access token, but documents oauth2
+		return ForgeCredentials{Username: "oauth2", Token: os.Getenv("GITLAB_TOKEN")}, nil
+	case FORGE_GITEA:
+		return ForgeCredentials{Username: os.Getenv("REPO_OWNER"), Token: os.Getenv("GITEA_TOKEN")}, nil
+	default:
+		if !githubAppConfigured() && os.Getenv("GITHUB_OAUTH_TOKEN") == "" {
+			return ForgeCredentials{}, nil
+		}
+		return getGithubCredentials(repo.Owner(), repo.Name(), repo.InstallationID)
+	}
+}
+
+// newForge returns the API client of the forge hosting the target's repository, for change requests against its base branch
+func newForge(target *Target) (Forge, error) {
+	repo, err := target.forgeRepo()
+	if err != nil {
+		return nil, err
+	}
+
+	if repo.Kind == FORGE_GITHUB {
+		githubClient, err := getGithubClient(repo.Owner(), repo.Name(), repo.InstallationID)
+		if err != nil {
+			return nil, err
+		}
+		if repo.APIURL != "" {
+			apiURL, err := url.Parse(strings.TrimSuffix(repo.APIURL, "/") + "/")
+			if err != nil {
+				return nil, fmt.Errorf("Invalid forge API URL %s: %v", repo.APIURL, err)
+			}
+			githubClient.BaseURL = apiURL
+		}
+		return newGithubForge(githubClient, repo.Owner(), repo.Name(), target.BaseBranch), nil
+	}
+
+	credentials, err := forgeCredentials(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	if credentials.Token == "" {
+		return nil, fmt.Errorf("You must set the %s_TOKEN env var to an access token for %s", strings.ToUpper(repo.Kind), repo.Path)
+	}
+
+	if repo.Kind == FORGE_GITLAB {
+		return newGitLabForge(repo, credentials.Token, target.BaseBranch), nil
+	}
+
+	return newGiteaForge(repo, credentials.Token, target.BaseBranch), nil
+}
+
+// forgeClient makes JSON requests to the REST APIs of the forges go-github doesn't cover
+type forgeClient struct {
+	apiURL string
+	// authHeader and authValue are the header each request is authenticated with
+	authHeader string
+	authValue  string
+	httpClient *http.Client
+}
+
+// newForgeClient creates a client for the API at apiURL, authenticating every request with the given header
+func newForgeClient(apiURL, authHeader, authValue string) *forgeClient {
+	return &forgeClient{
+		apiURL:     strings.TrimSuffix(apiURL, "/"),
+		authHeader: authHeader,
+		authValue:  authValue,
+		httpClient: &http.Client{Timeout: FORGE_HTTP_TIMEOUT},
+	}
+}
+
+// do sends body, if any, as JSON to the endpoint, which is relative to the API's root, and decodes the JSON response into
+// out, if given. Any status other than 2xx is returned as an error
+func (c *forgeClient) do(method, endpoint string, body, out interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, c.apiURL+"/"+strings.TrimPrefix(endpoint, "/"), reader)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set(c.authHeader, c.authValue)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp, fmt.Errorf("%s %s returned %s: %s", method, endpoint, resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil && err != io.EOF {
+			return resp, fmt.Errorf("Error decoding response from %s %s: %v", method, endpoint, err)
+		}
+	}
+
+	return resp, nil
+}
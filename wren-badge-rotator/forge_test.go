@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// forgeRequest is a request the fake forge API received, with its JSON body decoded
+type forgeRequest struct {
+	Route string
+	Body  map[string]interface{}
+}
+
+// fakeForgeAPI serves canned JSON responses keyed by "METHOD /path?query", and records every request it receives. A response
+// may set headers before its body, such as X-Next-Page, and routes it has no response for answer 404 Not Found
+type fakeForgeAPI struct {
+	t         *testing.T
+	responses map[string]fakeResponse
+	requests  []forgeRequest
+}
+
+// fakeResponse is a canned response to a route of the fake forge API
+type fakeResponse struct {
+	Header map[string]string
+	Body   string
+}
+
+// newFakeForgeAPI starts a fake forge API server, which is shut down when the test finishes
+func newFakeForgeAPI(t *testing.T, responses map[string]fakeResponse) (*fakeForgeAPI, string) {
+	api := &fakeForgeAPI{t: t, responses: responses}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	return api, server.URL
+}
+
+func (api *fakeForgeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := r.Method + " " + r.URL.RequestURI()
+
+	request := forgeRequest{Route: route}
+	if body, _ := ioutil.ReadAll(r.Body); len(body) > 0 {
+		if err := json.Unmarshal(body, &request.Body); err != nil {
+			api.t.Errorf("%s sent a body that isn't a JSON object: %s", route, body)
+		}
+	}
+	api.requests = append(api.requests, request)
+
+	response, ok := api.responses[route]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	for name, value := range response.Header {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(response.Body))
+}
+
+// routes lists the routes the fake forge API received requests for, in order
+func (api *fakeForgeAPI) routes() []string {
+	routes := []string{}
+	for _, request := range api.requests {
+		routes = append(routes, request.Route)
+	}
+	return routes
+}
+
+// lastBody is the body of the last request the fake forge API received for route
+func (api *fakeForgeAPI) lastBody(route string) map[string]interface{} {
+	for i := len(api.requests) - 1; i >= 0; i-- {
+		if api.requests[i].Route == route {
+			return api.requests[i].Body
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"sort"
+)
+
+const (
+	// GALLERY_INDEX_KEY is the gallery's landing page, listing every archived badge grouped by user
+	GALLERY_INDEX_KEY = "index.html"
+	// GALLERY_USERS_PREFIX holds a page per user showing how their stats trend over time
+	GALLERY_USERS_PREFIX = "users/"
+	// The dimensions of the trend chart drawn on each user's page
+	TREND_CHART_WIDTH   = 600
+	TREND_CHART_HEIGHT  = 160
+	TREND_CHART_PADDING = 20
+)
+
+// galleryUser is everything the gallery pages show for a single Wren user
+type galleryUser struct {
+	Name string
+	Page string
+	// Runs are the user's archived runs, newest first
+	Runs  []galleryRun
+	Trend template.HTML
+}
+
+// galleryRun is a single archived badge as listed in the gallery
+type galleryRun struct {
+	Run
+	Date     string
+	BadgeKey string
+}
+
+// publishGallery renders the gallery's index page and a page per user from the manifest, and uploads them to the store.
+// Every link is relative, so the gallery can be browsed from wherever the bucket is publicly served. A private bucket can't be
+// browsed at all, so no gallery is published to it
+func publishGallery(store ArtifactStore) error {
+	if !artifactsServedPublicly(store) {
+		fmt.Printf("Skipping the badge gallery, since the bucket isn't publicly served. Set S3_PUBLIC_BASE_URL or BADGE_HTML_ACCESS=public to publish it\n")
+		return nil
+	}
+
+	manifest, err := loadManifest(store)
+	if err != nil {
+		return err
+	}
+
+	users := map[string]*galleryUser{}
+	for _, run := range manifest.Runs {
+		// A badge that was never delivered, such as one the visual diff gate blocked, isn't part of the user's history
+		if !run.delivered() {
+			continue
+		}
+		name := run.User
+		if name == "" {
+			name = "unknown"
+		}
+		user, ok := users[name]
+		if !ok {
+			user = &galleryUser{Name: name, Page: GALLERY_USERS_PREFIX + name + ".html"}
+			users[name] = user
+		}
+		user.Runs = append(user.Runs, galleryRun{
+			Run:      run,
+			Date:     run.StartedAt.UTC().Format("January 2, 2006"),
+			BadgeKey: run.key(ARTIFACT_BADGE_PNG),
+		})
+	}
+
+	names := make([]string, 0, len(users))
+	for name, user := range users {
+		names = append(names, name)
+		sort.Slice(user.Runs, func(i, j int) bool {
+			return user.Runs[i].ID > user.Runs[j].ID
+		})
+		user.Trend = trendChart(user.Runs)
+	}
+	sort.Strings(names)
+
+	ordered := make([]*galleryUser, 0, len(names))
+	for _, name := range names {
+		ordered = append(ordered, users[name])
+	}
+
+	var index bytes.Buffer
+	if err := galleryIndexTemplate.Execute(&index, ordered); err != nil {
+		return err
+	}
+	if err := store.Put(GALLERY_INDEX_KEY, &index, putOptionsForKey(GALLERY_INDEX_KEY)); err != nil {
+		return err
+	}
+
+	for _, user := range ordered {
+		var page bytes.Buffer
+		if err := galleryUserTemplate.Execute(&page, user); err != nil {
+			return err
+		}
+		if err := store.Put(user.Page, &page, putOptionsForKey(user.Page)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// trendChart draws the tons offset of each run, oldest to newest, as an inline SVG line chart
+func trendChart(runs []galleryRun) template.HTML {
+	if len(runs) < 2 {
+		return ""
+	}
+
+	maxTons := 0.0
+	for _, run := range runs {
+		if run.Stats.TonsOffset > maxTons {
+			maxTons = run.Stats.TonsOffset
+		}
+	}
+	if maxTons == 0 {
+		maxTons = 1
+	}
+
+	plotWidth := float64(TREND_CHART_WIDTH - TREND_CHART_PADDING*2)
+	plotHeight := float64(TREND_CHART_HEIGHT - TREND_CHART_PADDING*2)
+
+	var points bytes.Buffer
+	for i := range runs {
+		// runs are newest first, so walk them backwards to plot left to right through time
+		run := runs[len(runs)-1-i]
+		x := float64(TREND_CHART_PADDING) + plotWidth*float64(i)/float64(len(runs)-1)
+		y := float64(TREND_CHART_PADDING) + plotHeight*(1-run.Stats.TonsOffset/maxTons)
+		fmt.Fprintf(&points, "%.1f,%.1f ", x, y)
+	}
+
+	// The points are formatted numbers only, so they are safe to mark as trusted HTML
+	return template.HTML(fmt.Sprintf(
+		`<svg width="%d" height="%d" viewBox="0 0 %d %d"><polyline fill="none" stroke="#27AE60" stroke-width="2" points="%s"/></svg>`,
+		TREND_CHART_WIDTH, TREND_CHART_HEIGHT, TREND_CHART_WIDTH, TREND_CHART_HEIGHT, points.String()))
+}
+
+// galleryStyle is shared by every gallery page
+const galleryStyle = `
+    <style>
+      body { font-family: 'Roboto', sans-serif; margin: 32px; color: #333333; }
+      h1, h2 { color: #27AE60; }
+      table { border-collapse: collapse; }
+      td, th { padding: 8px 12px; border-bottom: 1px solid #eeeeee; text-align: left; vertical-align: middle; }
+      img { max-width: 300px; }
+    </style>
+`
+
+var galleryIndexTemplate = template.Must(template.New("index").Parse(`<!doctype html>
+<html>
+  <head>
+    <title>Wren badge gallery</title>` + galleryStyle + `  </head>
+  <body>
+    <h1>Wren badge gallery</h1>
+    {{ range . }}
+    <h2><a href="{{ .Page }}">{{ .Name }}</a></h2>
+    <table>
+      <tr><th>Date</th><th>Badge</th><th>Stats</th><th>Download</th></tr>
+      {{ range .Runs }}
+      <tr>
+        <td>{{ .Date }}</td>
+        <td><img src="{{ .BadgeKey }}" alt="Wren badge for {{ .Date }}"></td>
+        <td>{{ .Stats.Tons }}</td>
+        <td><a href="{{ .BadgeKey }}" download>badge.png</a></td>
+      </tr>
+      {{ end }}
+    </table>
+    {{ else }}
+    <p>No badges have been archived yet.</p>
+    {{ end }}
+  </body>
+</html>
+`))
+
+var galleryUserTemplate = template.Must(template.New("user").Parse(`<!doctype html>
+<html>
+  <head>
+    <title>Wren badges for {{ .Name }}</title>` + galleryStyle + `  </head>
+  <body>
+    <p><a href="../index.html">All badges</a></p>
+    <h1>{{ .Name }}</h1>
+    {{ if .Trend }}
+    <h2>Tons offset over time</h2>
+    {{ .Trend }}
+    {{ end }}
+    <table>
+      <tr><th>Date</th><th>Badge</th><th>Tons offset</th><th>Download</th></tr>
+      {{ range .Runs }}
+      <tr>
+        <td>{{ .Date }}</td>
+        <td><img src="../{{ .BadgeKey }}" alt="Wren badge for {{ .Date }}"></td>
+        <td>{{ .Stats.TonsOffset }}</td>
+        <td><a href="../{{ .BadgeKey }}" download>badge.png</a></td>
+      </tr>
+      {{ end }}
+    </table>
+  </body>
+</html>
+`))
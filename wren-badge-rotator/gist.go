@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/google/go-github/v32/github"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// The files written to the badge gist. Gists are flat, so these are plain file names
+	GIST_BADGE_SVG_FILE = "wren-badge.svg"
+	GIST_BADGE_PNG_FILE = "wren-badge.png.base64"
+	GIST_STATS_FILE     = "stats.json"
+	// GIST_SNIPPET_FILE is the markdown snippet embedding the badge, which is also how a badge gist is recognized among the
+	// user's gists when no gist ID is configured
+	GIST_SNIPPET_FILE = "wren-badge.md"
+	// GIST_RAW_URL_FORMAT is the address of the latest revision of a gist's file, given its owner, ID and file name. Unlike the
+	// raw URLs in the API's responses, it doesn't change when the gist is updated
+	GIST_RAW_URL_FORMAT = "https://gist.githubusercontent.com/%s/%s/raw/%s"
+	// GIST_PAGE_SIZE is how many gists are listed per request while looking for the badge gist
+	GIST_PAGE_SIZE = 100
+)
+
+// getGistClient creates a Github API client for managing gists. Installation tokens can't manage gists, so this always
+// authenticates with a personal access token with the gist scope: GIST_TOKEN, or GITHUB_OAUTH_TOKEN if it has that scope
+func getGistClient() (*github.Client, error) {
+	token := getEnvString("GIST_TOKEN", os.Getenv("GITHUB_OAUTH_TOKEN"))
+	if token == "" {
+		return nil, errors.New("Delivering the badge to a gist requires the GIST_TOKEN or GITHUB_OAUTH_TOKEN env var set to a Github personal access token with the gist scope")
+	}
+
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+	return github.NewClient(oauth2.NewClient(context.Background(), ts)), nil
+}
+
+// gistBadgeFile returns the name and contents of the badge file in the gist, as set by the GIST_BADGE_FORMAT env var. Gists
+// only hold text, so the badge is either drawn as a vector SVG (svg, the default), which can be embedded by its raw URL, or
+// written as the base64 of the PNG (png)
+func gistBadgeFile(badge []byte, stats BadgeStats) (string, []byte, error) {
+	switch format := getEnvString("GIST_BADGE_FORMAT", "svg"); format {
+	case "svg":
+		return GIST_BADGE_SVG_FILE, badgeSVG(stats, defaultTheme), nil
+	case "png":
+		return GIST_BADGE_PNG_FILE, []byte(base64.StdEncoding.EncodeToString(badge)), nil
+	default:
+		return "", nil, fmt.Errorf("GIST_BADGE_FORMAT must be svg or png, got: %s", format)
+	}
+}
+
+// gistFileBytes is what a gist file holds, for comparing it with its new contents. The base64 PNG is decoded, so that a badge
+// that only differs in its embedded provenance counts as unchanged
+func gistFileBytes(name, content string) []byte {
+	if name == GIST_BADGE_PNG_FILE {
+		if decoded, err := base64.StdEncoding.DecodeString(content); err == nil {
+			return decoded
+		}
+	}
+	return []byte(content)
+}
+
+// gistRawURL is the stable raw URL of a file in the gist
+func gistRawURL(gist *github.Gist, name string) string {
+	return fmt.Sprintf(GIST_RAW_URL_FORMAT, gist.GetOwner().GetLogin(), gist.GetID(), name)
+}
+
+// gistSnippet is the markdown snippet written to the gist, ready to paste into a README: the badge embedded by its raw URL,
+// linking to Wren, and its headline stat. A base64 PNG can't be embedded, and a gist that doesn't exist yet has no raw URL,
+// so then the snippet only links to Wren
+func gistSnippet(gist *github.Gist, badgeFile string, stats BadgeStats) []byte {
+	snippet := fmt.Sprintf("[Project Wren badge](%s)", WrenBadgeURL)
+	if badgeFile == GIST_BADGE_SVG_FILE && gist != nil {
+		snippet = fmt.Sprintf("[![Wren badge](%s)](%s)", gistRawURL(gist, badgeFile), WrenBadgeURL)
+	}
+	if stats.Tons != "" {
+		snippet += fmt.Sprintf("\n\n%s", stats.Tons)
+	}
+	return []byte(snippet + "\n")
+}
+
+// findBadgeGist returns the target's gist, with the contents of its files. That is the gist whose ID is configured, or else the
+// authenticated user's gist holding a GIST_SNIPPET_FILE, which is nil if there is none yet
+func findBadgeGist(client *github.Client, target *Target) (*github.Gist, error) {
+	id := target.GistID
+
+	if id == "" {
+		var err error
+		id, err = findSnippetGistID(client)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if id == "" {
+		return nil, nil
+	}
+
+	// Listed gists leave out the contents of their files, so the gist is read on its own
+	gist, _, err := client.Gists.Get(context.Background(), id)
+	return gist, err
+}
+
+// findSnippetGistID looks through the authenticated user's gists for the first one holding a GIST_SNIPPET_FILE, and returns
+// its ID, which is empty if there is none
+func findSnippetGistID(client *github.Client) (string, error) {
+	opts := &github.GistListOptions{ListOptions: github.ListOptions{PerPage: GIST_PAGE_SIZE}}
+
+	for {
+		gists, resp, err := client.Gists.List(context.Background(), "", opts)
+		if err != nil {
+			return "", err
+		}
+
+		for _, gist := range gists {
+			if _, ok := gist.Files[GIST_SNIPPET_FILE]; ok {
+				return gist.GetID(), nil
+			}
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	return "", nil
+}
+
+// updateBadgeGist publishes the badge to a Github gist, for anyone who wants a stable URL to embed rather than a repository to
+// maintain:
+// 1. Find the target's gist, or create a secret gist (public with GIST_PUBLIC) holding the badge, its stats and a snippet
+// 2. Render the badge, its stats as stats.json and a markdown snippet embedding the badge by its raw URL, and compare them with
+// the gist's files, stopping if none of them changed
+// 3. Edit the gist, replacing only the files that changed
+// The gist's history keeps every earlier badge, and the raw URLs of its files, which always serve the latest revision, are
+// reported in the run's summary. The visual regression check is skipped, since the gist doesn't hold a PNG to compare with
+func updateBadgeGist(run *Run, target *Target) (DeliveryResult, error) {
+	client, clientErr := getGistClient()
+
+	if clientErr != nil {
+		return DeliveryResult{}, clientErr
+	}
+
+	badge, readErr := ioutil.ReadFile(EXTRACTED_BADGE_IMAGE_LOCAL_PATH)
+
+	if readErr != nil {
+		return DeliveryResult{}, readErr
+	}
+
+	badgeFile, badgeContents, badgeErr := gistBadgeFile(badge, run.Stats)
+
+	if badgeErr != nil {
+		return DeliveryResult{}, badgeErr
+	}
+
+	stats, statsErr := json.MarshalIndent(run.Stats, "", "  ")
+
+	if statsErr != nil {
+		return DeliveryResult{}, statsErr
+	}
+
+	gist, findErr := findBadgeGist(client, target)
+
+	if findErr != nil {
+		return DeliveryResult{}, findErr
+	}
+
+	// What the update did to each file is reported against the gist as it was before this run, which is empty when it is created
+	previousFiles := map[github.GistFilename]github.GistFile{}
+
+	if gist == nil {
+		var createErr error
+		gist, _, createErr = client.Gists.Create(context.Background(), &github.Gist{
+			Description: github.String(fmt.Sprintf("Project Wren badge for %s", run.User)),
+			Public:      github.Bool(getEnvBool("GIST_PUBLIC")),
+			Files: map[github.GistFilename]github.GistFile{
+				github.GistFilename(badgeFile):       {Content: github.String(string(badgeContents))},
+				github.GistFilename(GIST_STATS_FILE): {Content: github.String(string(stats))},
+				// The snippet is how the gist is found again, should the edit below embedding the badge in it fail
+				github.GistFilename(GIST_SNIPPET_FILE): {Content: github.String(string(gistSnippet(nil, badgeFile, run.Stats)))},
+			},
+		})
+
+		if createErr != nil {
+			return DeliveryResult{}, createErr
+		}
+
+		fmt.Printf("Created gist %s for the badge, set GIST_ID to %s to keep updating it\n", gist.GetHTMLURL(), gist.GetID())
+	} else {
+		previousFiles = gist.Files
+	}
+
+	// The snippet embeds the badge by a raw URL that needs the gist's ID, so it can only be rendered in full once the gist exists
+	files := []RepoFile{
+		{Path: badgeFile, Contents: badgeContents},
+		{Path: GIST_STATS_FILE, Contents: stats},
+		{Path: GIST_SNIPPET_FILE, Contents: gistSnippet(gist, badgeFile, run.Stats)},
+	}
+
+	result := DeliveryResult{GistURL: gist.GetHTMLURL()}
+	edits := map[github.GistFilename]github.GistFile{}
+
+	for _, file := range files {
+		name := github.GistFilename(file.Path)
+
+		previous, found := previousFiles[name]
+		status := fileStatus(gistFileBytes(file.Path, string(file.Contents)), gistFileBytes(file.Path, previous.GetContent()), found)
+		result.Files = append(result.Files, FileChange{Path: file.Path, Status: status})
+		result.GistRawURLs = append(result.GistRawURLs, gistRawURL(gist, file.Path))
+
+		current, ok := gist.Files[name]
+		if !ok || fileStatus(gistFileBytes(file.Path, string(file.Contents)), gistFileBytes(file.Path, current.GetContent()), true) != FILE_UNCHANGED {
+			edits[name] = github.GistFile{Content: github.String(string(file.Contents))}
+		}
+	}
+
+	logFileChanges(result.Files)
+
+	if len(edits) == 0 {
+		return result, nil
+	}
+
+	_, _, editErr := client.Gists.Edit(context.Background(), gist.GetID(), &github.Gist{Files: edits})
+
+	if editErr != nil {
+		return DeliveryResult{}, editErr
+	}
+
+	fmt.Printf("Updated %d files of gist %s\n", len(edits), gist.GetHTMLURL())
+
+	result.GistUpdated = true
+	return result, nil
+}
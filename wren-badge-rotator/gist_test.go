@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v32/github"
+)
+
+func TestFindBadgeGist(t *testing.T) {
+	const (
+		page1 = "GET /gists?per_page=100"
+		page2 = "GET /gists?page=2&per_page=100"
+		get   = "GET /gists/badge"
+	)
+
+	tests := []struct {
+		name       string
+		gistID     string
+		responses  map[string]fakeResponse
+		wantRoutes []string
+		wantFound  bool
+	}{
+		{
+			name:       "configured gist",
+			gistID:     "badge",
+			responses:  map[string]fakeResponse{get: {Body: `{"id": "badge"}`}},
+			wantRoutes: []string{get},
+			wantFound:  true,
+		},
+		{
+			name: "snippet gist on a later page",
+			responses: map[string]fakeResponse{
+				page1: {Body: `[{"id": "notes", "files": {"notes.md": {}}}]`},
+				page2: {Body: `[{"id": "badge", "files": {"wren-badge.md": {}}}, {"id": "later", "files": {"wren-badge.md": {}}}]`},
+				get:   {Body: `{"id": "badge"}`},
+			},
+			wantRoutes: []string{page1, page2, get},
+			wantFound:  true,
+		},
+		{
+			name: "no snippet gist",
+			responses: map[string]fakeResponse{
+				page1: {Body: `[{"id": "notes", "files": {"notes.md": {}}}]`},
+				page2: {Body: `[]`},
+			},
+			wantRoutes: []string{page1, page2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, apiURL := newFakeForgeAPI(t, tt.responses)
+			// go-github follows the Link header to the next page
+			if response, ok := tt.responses[page1]; ok {
+				response.Header = map[string]string{"Link": `<` + apiURL + `/gists?page=2&per_page=100>; rel="next"`}
+				tt.responses[page1] = response
+			}
+
+			client := github.NewClient(nil)
+			client.BaseURL, _ = url.Parse(apiURL + "/")
+
+			gist, err := findBadgeGist(client, &Target{GistID: tt.gistID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (gist != nil) != tt.wantFound || (gist != nil && gist.GetID() != "badge") {
+				t.Errorf("findBadgeGist() = %v, want found %v", gist, tt.wantFound)
+			}
+			if routes := strings.Join(api.routes(), ", "); routes != strings.Join(tt.wantRoutes, ", ") {
+				t.Errorf("Requests = %s, want %s", routes, strings.Join(tt.wantRoutes, ", "))
+			}
+		})
+	}
+}
+
+func TestGistSnippetBeforeCreation(t *testing.T) {
+	gist := &github.Gist{ID: github.String("badge"), Owner: &github.User{Login: github.String("zackproser")}}
+	stats := BadgeStats{Tons: "12 tons"}
+
+	if snippet := string(gistSnippet(nil, GIST_BADGE_SVG_FILE, stats)); strings.Contains(snippet, "gist.githubusercontent.com") || !strings.Contains(snippet, WrenBadgeURL) {
+		t.Errorf("The snippet a gist is created with should only link to Wren, got: %s", snippet)
+	}
+	if snippet := string(gistSnippet(gist, GIST_BADGE_SVG_FILE, stats)); !strings.Contains(snippet, "https://gist.githubusercontent.com/zackproser/badge/raw/wren-badge.svg") {
+		t.Errorf("The snippet should embed the badge by its raw URL, got: %s", snippet)
+	}
+}
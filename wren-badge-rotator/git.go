@@ -6,28 +6,37 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
-	"path"
 	"time"
 
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
 	"github.com/google/go-github/v32/github"
 	"golang.org/x/oauth2"
 )
 
-// getGithubClient uses the Github personal access token defined as an environment variable to create a new Github API client
+// FORK_REMOTE_NAME is the remote the fork is added to the local clone as, when pushing to a fork
+const FORK_REMOTE_NAME = "fork"
+
+// getGithubClient creates a new Github API client for the owner/repo repository, authenticated as a Github App installation or
+// with a Github personal access token, as getGithubCredentials decides
 // This client will be used to make the API call to Github to create the Pull Request updating the badge
-func getGithubClient() (*github.Client, error) {
-	if os.Getenv("GITHUB_OAUTH_TOKEN") == "" {
-		return nil, errors.New("You must set the GITHUB_OAUTH_TOKEN env var to a valid Github personal access token")
+func getGithubClient(owner, repo string, installationID int64) (*github.Client, error) {
+	credentials, credentialsErr := getGithubCredentials(owner, repo, installationID)
+
+	if credentialsErr != nil {
+		return nil, credentialsErr
 	}
 
 	ctx := context.Background()
 	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: os.Getenv("GITHUB_OAUTH_TOKEN")},
+		&oauth2.Token{AccessToken: credentials.Token},
 	)
 	tc := oauth2.NewClient(ctx, ts)
 
@@ -36,26 +45,68 @@ func getGithubClient() (*github.Client, error) {
 	return client, nil
 }
 
-// cloneRepo uses the go-git library to clone my Github profile repository to a newly created /tmp/directory
-// This way the badge image can be updated and committed in place, and pushed during execution, and it's fine for
-// everything else to be discarded following the lambda execution, since this function will tend to be run once per month on average
-func cloneRepo() (string, *git.Repository, error) {
+// cloneRepo uses the go-git library to make a shallow clone of the base branch of my Github profile repository, or another
+// target repository, holding both the repository and its worktree in memory. Only the latest commit is fetched, so the badge
+// image can be updated, committed and pushed without downloading the profile's full image history or writing anything to the
+// Lambda's /tmp directory, and everything is simply discarded following the lambda execution.
+// A branch pushed to a fork can only be sent along with any of its history the fork is missing, such as when the fork's base
+// branch is behind, so the base branch's full history is cloned when pushing to a fork
+func cloneRepo(target *Target, branch string, shallow bool) (*git.Repository, error) {
+	auth, authErr := repoAuth(target.RepoURL, target)
+
+	if authErr != nil {
+		return nil, authErr
+	}
+
+	cloneOptions := &git.CloneOptions{
+		URL:           target.RepoURL,
+		ReferenceName: plumbing.NewBranchReferenceName(branch),
+		SingleBranch:  true,
+		Auth:          auth,
+	}
 
-	repositoryDir, tmpDirErr := ioutil.TempDir("", "wren-badge-rotator")
-	if tmpDirErr != nil {
-		return "", nil, tmpDirErr
+	if shallow {
+		cloneOptions.Depth = 1
 	}
 
-	localRepository, err := git.PlainClone(repositoryDir, false, &git.CloneOptions{
-		URL:      REPO_URL,
-		Progress: os.Stdout,
-	})
+	localRepository, err := git.Clone(memory.NewStorage(), memfs.New(), cloneOptions)
 
 	if err != nil {
-		return "", nil, err
+		return nil, err
+	}
+
+	return localRepository, nil
+}
+
+// repoAuth returns the HTTP basic auth used to clone and push to repoURL, the target's repository or its fork, using the same
+// credentials as the API of the forge hosting it, which the target names when the URL doesn't give it away. It is nil when no
+// credentials are configured, or when the repository isn't hosted on a forge, such as when it is a local one
+func repoAuth(repoURL string, target *Target) (transport.AuthMethod, error) {
+	forgeRepo, parseErr := parseForgeRepo(repoURL, target.Forge, "")
+
+	if parseErr != nil {
+		return nil, nil
+	}
+
+	// The target's Github App installation covers its own repository, while a fork is looked up
+	if repoURL == target.RepoURL {
+		forgeRepo.InstallationID = target.GithubAppInstallationID
 	}
 
-	return repositoryDir, localRepository, nil
+	credentials, credentialsErr := forgeCredentials(forgeRepo)
+
+	if credentialsErr != nil {
+		return nil, credentialsErr
+	}
+
+	if credentials.Token == "" {
+		return nil, nil
+	}
+
+	return &http.BasicAuth{
+		Username: credentials.Username,
+		Password: credentials.Token,
+	}, nil
 }
 
 // getLocalRepoHeadRef looks up the HEAD reference of the locally cloned git repository, which is required by
@@ -69,7 +120,7 @@ func getLocalRepoHeadRef(localRepository *git.Repository) (*plumbing.Reference,
 }
 
 // getLocalWorkTree looks up the working tree of the locally cloned repository and returns it if possible, or an error
-func getLocalWorkTree(repositoryDir string, localRepository *git.Repository) (*git.Worktree, error) {
+func getLocalWorkTree(localRepository *git.Repository) (*git.Worktree, error) {
 	worktree, worktreeErr := localRepository.Worktree()
 
 	if worktreeErr != nil {
@@ -78,16 +129,28 @@ func getLocalWorkTree(repositoryDir string, localRepository *git.Repository) (*g
 	return worktree, nil
 }
 
-// checkoutLocalBranch creates a local branch specific to this tool in the locally checked out copy of the repo in the /tmp folder
-func checkoutLocalBranch(ref *plumbing.Reference, worktree *git.Worktree, localRepository *git.Repository) (plumbing.ReferenceName, error) {
+// copyPreviousBadge copies the badge currently in the worktree's filesystem to previousPath, since the visual regression check
+// decodes it from disk and the in-memory worktree has no path on disk
+func copyPreviousBadge(fs billy.Filesystem, badgePath, previousPath string) error {
+	previous, found, readErr := readBillyFile(fs, badgePath)
 
-	t := time.Now()
-	month := t.Month()
+	if readErr != nil {
+		return readErr
+	}
 
-	// Create a branch name that contains the Month so that it's easier to scan and understand
-	branchNameWithMonth := fmt.Sprintf("update-wren-badge-%s", month)
+	if !found {
+		// Make sure a badge left behind by an earlier invocation of this Lambda container isn't compared against
+		os.Remove(previousPath)
+		return nil
+	}
 
-	branchName := plumbing.NewBranchReferenceName(branchNameWithMonth)
+	return ioutil.WriteFile(previousPath, previous, 0644)
+}
+
+// checkoutLocalBranch creates a local branch specific to this tool in the locally checked out copy of the repo in the /tmp folder
+func checkoutLocalBranch(ref *plumbing.Reference, worktree *git.Worktree, localRepository *git.Repository, branch string) (plumbing.ReferenceName, error) {
+
+	branchName := plumbing.NewBranchReferenceName(branch)
 	// Create a branch specific to the multi repo script runner
 	co := &git.CheckoutOptions{
 		Hash:   ref.Hash(),
@@ -105,14 +168,15 @@ func checkoutLocalBranch(ref *plumbing.Reference, worktree *git.Worktree, localR
 	return branchName, nil
 }
 
-// commitLocalChanges will commit the modified badge image to the local checkout of the repo so that it can be pushed to the remote origin next
-func commitLocalChanges(worktree *git.Worktree, localRepository *git.Repository, repositoryDir string) error {
+// commitLocalChanges will commit the modified badge image to the local checkout of the repo so that it can be pushed to the remote origin next.
+// When a signing key is configured, the commit is signed with it and its signature verified, for repositories that require signed commits
+func commitLocalChanges(worktree *git.Worktree, localRepository *git.Repository, run *Run, target *Target) (plumbing.Hash, error) {
 
-	t := time.Now()
-	month := t.Month()
+	commitMessage, messageErr := badgeCommitMessage(run, target)
 
-	// Create a commit message that contains the current month for easier scanning
-	commitMessage := fmt.Sprintf("Update Project Wren Badge with monthly stats for %s", month)
+	if messageErr != nil {
+		return plumbing.ZeroHash, messageErr
+	}
 
 	// We can now create a commit, passing the All
 	// option when configuring our commit option so that all modified and deleted files
@@ -126,26 +190,67 @@ func commitLocalChanges(worktree *git.Worktree, localRepository *git.Repository,
 		},
 	}
 
-	_, commitErr := worktree.Commit(commitMessage, commitOps)
+	signKey, signKeyErr := getCommitSigningKey()
+
+	if signKeyErr != nil {
+		return plumbing.ZeroHash, signKeyErr
+	}
+
+	commitOps.SignKey = signKey
+
+	hash, commitErr := worktree.Commit(commitMessage, commitOps)
 
 	if commitErr != nil {
-		return commitErr
+		return plumbing.ZeroHash, commitErr
 	}
 
-	return nil
+	if signKey != nil {
+		if verifyErr := verifyCommitSignature(localRepository, hash, signKey); verifyErr != nil {
+			return plumbing.ZeroHash, verifyErr
+		}
+	}
+
+	return hash, nil
 }
 
-// pushLocalBranch pushes the branch in the local clone of the /tmp/ directory repository to the Github remote origin
-// so that a pull request can be opened against it via the Github API. Note this step requires http.BasicAuth to perform
-// so I log identify myself to Github via my username and my Github personal access token as my password
-func pushLocalBranch(localRepository *git.Repository) error {
+// pushLocalBranch pushes the branch in the in-memory clone of the repository at repoURL to the Github remote origin, or to fork
+// when it isn't nil, so that a pull request can be opened against it via the Github API. Note this step requires http.BasicAuth to perform
+// so I identify myself to Github via my username and my Github personal access token as my password, or as the Github App
+// with an installation token for the repository.
+// The push of the badge branch is forced, so that a rerun in the same month replaces the branch left behind by the previous run,
+// while pushes straight to the base branch never are
+func pushLocalBranch(localRepository *git.Repository, target *Target, fork *Fork, branchName plumbing.ReferenceName, force bool) error {
+	remoteName, remoteURL := git.DefaultRemoteName, target.RepoURL
+
+	if fork != nil {
+		remoteName, remoteURL = FORK_REMOTE_NAME, fork.CloneURL
+
+		_, remoteErr := localRepository.CreateRemote(&config.RemoteConfig{
+			Name: remoteName,
+			URLs: []string{remoteURL},
+		})
+
+		if remoteErr != nil {
+			return remoteErr
+		}
+	}
+
+	auth, authErr := repoAuth(remoteURL, target)
+
+	if authErr != nil {
+		return authErr
+	}
+
+	refSpec := fmt.Sprintf("%s:%s", branchName, branchName)
+	if force {
+		refSpec = "+" + refSpec
+	}
+
 	// Push the changes to the remote repo
 	po := &git.PushOptions{
-		RemoteName: "origin",
-		Auth: &http.BasicAuth{
-			Username: os.Getenv("REPO_OWNER"),
-			Password: os.Getenv("GITHUB_OAUTH_TOKEN"),
-		},
+		RemoteName: remoteName,
+		RefSpecs:   []config.RefSpec{config.RefSpec(refSpec)},
+		Auth:       auth,
 	}
 	pushErr := localRepository.Push(po)
 
@@ -157,123 +262,216 @@ func pushLocalBranch(localRepository *git.Repository) error {
 	return nil
 }
 
-// Attempt to open a pull request via the Github API, of the branch containing the badge changes against the master branch
-func openPullRequest(GithubClient *github.Client, branch string) error {
+// updateBadgeContents renders every output of the target into the worktree of the local clone and stages the files that were
+// added or modified, so the commit that follows picks them up
+func updateBadgeContents(worktree *git.Worktree, run *Run, outputs []BadgeOutput) ([]FileChange, error) {
+	readExisting := func(filePath string) ([]byte, bool, error) {
+		return readBillyFile(worktree.Filesystem, filePath)
+	}
 
-	t := time.Now()
-	month := t.Month()
+	files, renderErr := renderOutputs(outputs, run, readExisting)
 
-	pullRequestTitle := fmt.Sprintf("Update Project Wren Badge for %s", month)
-	pullRequestDescription := fmt.Sprintf("Swap in the latest badge with the stats for %s", month)
+	if renderErr != nil {
+		return nil, renderErr
+	}
 
-	repoName := os.Getenv("REPO_OWNER")
+	changes, writeErr := writeRepoFiles(worktree.Filesystem, files)
 
-	// Configure pull request options that the Github client accepts when making calls to open new pull requests
-	newPR := &github.NewPullRequest{
-		Title:               github.String(pullRequestTitle),
-		Head:                github.String(branch),
-		Base:                github.String("master"),
-		Body:                github.String(pullRequestDescription),
-		MaintainerCanModify: github.Bool(true),
+	if writeErr != nil {
+		return nil, writeErr
 	}
 
-	// Make a pull request via the Github API
-	pr, _, err := GithubClient.PullRequests.Create(context.Background(), repoName, repoName, newPR)
+	logFileChanges(changes)
 
-	if err != nil {
-		return err
+	for _, change := range changes {
+		if change.Status == FILE_UNCHANGED {
+			continue
+		}
+		if _, addErr := worktree.Add(change.Path); addErr != nil {
+			return nil, addErr
+		}
 	}
 
-	fmt.Printf("Successfully opened Pull Request: %s", pr.GetHTMLURL())
-
-	return nil
+	return changes, nil
 }
 
-// updateBadgeContents will intentionally overwrite the existing /img/carbon-wren.png badge that exists in the locally checked out repository
-// by copying over it the local version of the updated badge image
-func updateBadgeContents(repositoryDir string) error {
+// updateBadgeImage updates the badge image in the target repository, such as my Github profile, either entirely through the Github
+// API or by cloning the repository, depending on the REPO_UPDATE_METHOD env var, and delivers it as the target's delivery mode
+// requires. Gist targets are published to their gist instead
+func updateBadgeImage(store ArtifactStore, run *Run, target *Target) (DeliveryResult, error) {
+	if target.Mode == DELIVERY_GIST {
+		return updateBadgeGist(run, target)
+	}
 
-	badgePath := path.Join(repositoryDir, "img", "carbon-wren.png")
+	method, methodErr := repoUpdateMethod(target)
 
-	// Overwrite the existing local repo's copy of the previous badge with the freshly extracted and updated badge
-	cmd := exec.Command("cp", EXTRACTED_BADGE_IMAGE_LOCAL_PATH, badgePath)
-	stdout, err := cmd.Output()
+	if methodErr != nil {
+		return DeliveryResult{}, methodErr
+	}
 
-	if err != nil {
-		return err
+	if target.PushToFork {
+		if target.Mode == DELIVERY_DIRECT {
+			return DeliveryResult{}, errors.New("PUSH_TO_FORK can't be combined with DELIVERY_MODE direct, which commits straight to the base branch")
+		}
+		if method == "api" {
+			return DeliveryResult{}, errors.New("PUSH_TO_FORK requires REPO_UPDATE_METHOD clone, since the branch is pushed to the fork with git")
+		}
 	}
 
-	fmt.Printf("cp updated badge into place output: %s\n", string(stdout))
+	if target.AssetsBranch != "" {
+		if target.PushToFork {
+			return DeliveryResult{}, errors.New("An assets branch can't be combined with PUSH_TO_FORK, since images are embedded from the repository itself")
+		}
+		if method == "api" {
+			return DeliveryResult{}, errors.New("An assets branch requires REPO_UPDATE_METHOD clone, since it is pushed with git")
+		}
+	}
 
-	return nil
+	var result DeliveryResult
+	var err error
+
+	if target.AssetsBranch != "" {
+		result, err = updateBadgeImageViaAssetsBranch(store, run, target)
+	} else if method == "api" {
+		owner, repo, ok := parseGithubRepo(target.RepoURL)
+		if !ok {
+			return DeliveryResult{}, fmt.Errorf("REPO_UPDATE_METHOD api requires a github.com repository, got: %s", target.RepoURL)
+		}
+		result, err = updateBadgeImageViaAPI(store, run, target, owner, repo)
+	} else {
+		result, err = updateBadgeImageViaClone(store, run, target)
+	}
+
+	result.BaseBranch = target.BaseBranch
+	return result, err
 }
 
-// updateBadgeImage wraps all the operations that need to occur in order to update the badge image on my Github profile:
-// 1. Clone the zackproser/zackproser repository to a local /tmp directory
+// updateBadgeImageViaClone wraps all the operations that need to occur in order to update the badge image on my Github profile by cloning it:
+// 1. Shallow clone the base branch of the target repository, such as zackproser/zackproser, into memory
 // 2. Get the HEAD ref from that repository for use in branching
 // 3. Get the local worktree of that repository for use in commiting changes
-// 4. Checkout a new local branch specific to the month the update is being run in
-// 5. Overwrite the badge image contents that are currently in the Github repository's img directory with the contents
-// of the badge that have now been scraped from wren and then processed into an image via the HCTI API and then
-// stored under the /extracted prefix within the S3 bucket
-// 6. Commit this file change, using my own signature
-// 7. Push the local branch to the remote origin, using my Github personal access token and HTTP basic auth as transport.Auth scheme
-// 8. Using my Github personal access token, obtain a Github API client and make a call to create a Pull Request
-func updateBadgeImage() error {
+// 4. Checkout a new local branch specific to the user and month the update is being run in, unless committing directly to the base branch
+// 5. Compare the badge currently in the repository with the new badge, and stop if they differ by more than a monthly update would
+// 6. Write every output of the target into the worktree - the badge that has now been scraped from wren, processed into an
+// image via the HCTI API and archived with the rest of the run's artifacts, plus any resized, SVG, stats and README outputs -
+// stopping if none of them changed
+// 7. Commit these file changes, using my own signature
+// 8. Push the local branch to the remote origin, using my Github personal access token and HTTP basic auth as transport.Auth scheme.
+// With PUSH_TO_FORK, for credentials that can only read the repository, the branch is pushed to a fork of it instead, which is
+// created first if need be
+// 9. Using the API of the forge hosting the repository - Github, GitLab or Gitea - create a Pull Request (a Merge Request on
+// GitLab), or refresh the one already open for the branch, then merge it or request reviewers as the delivery mode requires
+func updateBadgeImageViaClone(store ArtifactStore, run *Run, target *Target) (DeliveryResult, error) {
+	mode := target.Mode
+
+	// Set up the forge API client first, so a repository that can't take Pull Requests fails before anything is pushed
+	var forge Forge
+
+	if mode != DELIVERY_DIRECT {
+		var forgeErr error
+		forge, forgeErr = newForge(target)
+
+		if forgeErr != nil {
+			return DeliveryResult{}, forgeErr
+		}
+	}
+
+	var fork *Fork
 
-	repositoryDir, localRepository, cloneErr := cloneRepo()
+	if target.PushToFork {
+		var forkErr error
+		fork, forkErr = forge.EnsureFork()
+
+		if forkErr != nil {
+			return DeliveryResult{}, forkErr
+		}
+
+		fmt.Printf("Pushing the badge branch to the fork %s\n", fork.CloneURL)
+	}
+
+	localRepository, cloneErr := cloneRepo(target, target.BaseBranch, fork == nil)
 
 	if cloneErr != nil {
-		return cloneErr
+		return DeliveryResult{}, cloneErr
 	}
 
-	fmt.Printf("Local repository cloned to: %s\n", repositoryDir)
+	fmt.Printf("Cloned the %s branch of %s into memory\n", target.BaseBranch, target.RepoURL)
 
 	ref, headRefErr := getLocalRepoHeadRef(localRepository)
 
 	if headRefErr != nil {
-		return headRefErr
+		return DeliveryResult{}, headRefErr
 	}
 
-	worktree, worktreeErr := getLocalWorkTree(repositoryDir, localRepository)
+	worktree, worktreeErr := getLocalWorkTree(localRepository)
 
 	if worktreeErr != nil {
-		return worktreeErr
+		return DeliveryResult{}, worktreeErr
 	}
 
-	branchName, branchErr := checkoutLocalBranch(ref, worktree, localRepository)
+	// Direct commits go onto the branch the clone checked out, which is the base branch
+	branchName := ref.Name()
+
+	if mode != DELIVERY_DIRECT {
+		branch, branchErr := badgeBranchName(run, target)
 
-	if branchErr != nil {
-		return branchErr
+		if branchErr != nil {
+			return DeliveryResult{}, branchErr
+		}
+
+		branchName, branchErr = checkoutLocalBranch(ref, worktree, localRepository, branch)
+
+		if branchErr != nil {
+			return DeliveryResult{}, branchErr
+		}
 	}
 
-	updateErr := updateBadgeContents(repositoryDir)
+	// With an assets branch, the badge was already compared with the one on that branch
+	if target.AssetsBranch == "" {
+		copyErr := copyPreviousBadge(worktree.Filesystem, primaryBadgePath(target.Outputs), target.previousBadgePath())
+
+		if copyErr != nil {
+			return DeliveryResult{}, copyErr
+		}
+
+		visualErr := checkVisualRegression(store, run, target)
+
+		if visualErr != nil {
+			return DeliveryResult{}, visualErr
+		}
+	}
+
+	changes, updateErr := updateBadgeContents(worktree, run, target.Outputs)
 
 	if updateErr != nil {
-		return updateErr
+		return DeliveryResult{}, updateErr
+	}
+
+	if !hasChanges(changes) {
+		return DeliveryResult{Files: changes}, nil
 	}
 
-	commitErr := commitLocalChanges(worktree, localRepository, repositoryDir)
+	hash, commitErr := commitLocalChanges(worktree, localRepository, run, target)
 	if commitErr != nil {
-		return commitErr
+		return DeliveryResult{}, commitErr
 	}
 
-	pushErr := pushLocalBranch(localRepository)
+	pushErr := pushLocalBranch(localRepository, target, fork, branchName, mode != DELIVERY_DIRECT)
 
 	if pushErr != nil {
-		return pushErr
+		return DeliveryResult{}, pushErr
 	}
 
-	githubClient, clientErr := getGithubClient()
-
-	if clientErr != nil {
-		return clientErr
+	if mode == DELIVERY_DIRECT {
+		return DeliveryResult{CommitSHA: hash.String(), Merged: true, Files: changes}, nil
 	}
 
-	openPRErr := openPullRequest(githubClient, branchName.String())
+	pr, openPRErr := openOrUpdatePullRequest(forge, store, run, target, fork, branchName.Short())
 	if openPRErr != nil {
-		return openPRErr
+		return DeliveryResult{}, openPRErr
 	}
 
-	return nil
+	result, finishErr := finishPullRequest(forge, pr, hash.String(), target)
+	result.Files = changes
+	return result, finishErr
 }
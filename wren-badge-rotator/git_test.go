@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// initBareRemote creates a bare repository on disk whose main branch holds a single commit with a README, and returns its
+// file:// URL
+func initBareRemote(t *testing.T) string {
+	dir := t.TempDir()
+	if _, err := git.PlainInit(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	remoteURL := "file://" + dir
+
+	seed, err := git.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := seed.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeRepoFiles(worktree.Filesystem, []RepoFile{{Path: "README.md", Contents: []byte("# Profile\n")}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Add("README.md"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Commit("Initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := seed.CreateRemote(&config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{remoteURL}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := seed.Push(&git.PushOptions{RefSpecs: []config.RefSpec{"refs/heads/master:refs/heads/main"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	return remoteURL
+}
+
+// commitBadge clones the remote's main branch, commits badge to the badge path on branch, and pushes it
+func commitBadge(t *testing.T, remoteURL, branch, badge string, force bool) plumbing.Hash {
+	target := &Target{RepoURL: remoteURL, BaseBranch: "main"}
+	repo, err := cloneRepo(target, target.BaseBranch, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := getLocalRepoHeadRef(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := getLocalWorkTree(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	branchName := ref.Name()
+	if branch != "main" {
+		if branchName, err = checkoutLocalBranch(ref, worktree, repo, branch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changes, err := writeRepoFiles(worktree.Filesystem, []RepoFile{{Path: BADGE_REPO_PATH, Contents: []byte(badge)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Add(changes[0].Path); err != nil {
+		t.Fatal(err)
+	}
+
+	run := &Run{ID: "run", User: "zackproser", StartedAt: time.Date(2026, 10, 2, 8, 0, 0, 0, time.UTC)}
+	hash, err := commitLocalChanges(worktree, repo, run, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pushLocalBranch(repo, target, nil, branchName, force); err != nil {
+		t.Fatal(err)
+	}
+
+	return hash
+}
+
+// remoteBadge reads the badge committed at the tip of branch in the remote
+func remoteBadge(t *testing.T, remoteURL, branch string) (plumbing.Hash, string) {
+	repo, err := cloneRepo(&Target{RepoURL: remoteURL}, branch, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := getLocalRepoHeadRef(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := getLocalWorkTree(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, found, err := readBillyFile(worktree.Filesystem, BADGE_REPO_PATH)
+	if err != nil || !found {
+		t.Fatalf("Reading %s on %s: found %v, %v", BADGE_REPO_PATH, branch, found, err)
+	}
+	return ref.Hash(), string(contents)
+}
+
+func TestCloneCommitPush(t *testing.T) {
+	remoteURL := initBareRemote(t)
+
+	// A direct delivery commits onto the base branch itself
+	hash := commitBadge(t, remoteURL, "main", "direct badge", false)
+	if head, badge := remoteBadge(t, remoteURL, "main"); head != hash || badge != "direct badge" {
+		t.Errorf("main is at %s with badge %q, want %s with %q", head, badge, hash, "direct badge")
+	}
+
+	// A badge branch is force-pushed, so a rerun in the same month replaces the branch the previous run left behind
+	commitBadge(t, remoteURL, "update-wren-badge", "first badge", true)
+	hash = commitBadge(t, remoteURL, "update-wren-badge", "second badge", true)
+	if head, badge := remoteBadge(t, remoteURL, "update-wren-badge"); head != hash || badge != "second badge" {
+		t.Errorf("The badge branch is at %s with badge %q, want %s with %q", head, badge, hash, "second badge")
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+)
+
+const (
+	// BADGE_REPO_PATH is where the badge image lives in the profile repository
+	BADGE_REPO_PATH = "img/carbon-wren.png"
+	// BADGE_REPO_BASE_BRANCH is the branch pull requests updating the badge are opened against, unless a target names another
+	BADGE_REPO_BASE_BRANCH = "master"
+	// BADGE_BRANCH_PREFIX starts the name of every branch this tool creates by default
+	BADGE_BRANCH_PREFIX = "update-wren-badge-"
+	// PREVIOUS_BADGE_LOCAL_PATH is where the badge currently in the profile repository is downloaded or copied to, so that it
+	// can be compared with the new badge. Each target has its own copy, named after it
+	PREVIOUS_BADGE_LOCAL_PATH = "/tmp/previous-badge.png"
+)
+
+// repoUpdateMethod returns how the profile repository is updated, as set by the REPO_UPDATE_METHOD env var: "api" makes the
+// commit entirely through the Github Git Data API, while "clone" clones the repository with go-git and pushes a branch. When
+// unset, Github repositories are updated through the API, since it needs no local clone, and any other remote is cloned, as is
+// any repository whose badge branch is pushed to a fork, whose badge is written to an assets branch, or whose commits are signed
+// with COMMIT_SIGNING_KEY
+func repoUpdateMethod(target *Target) (string, error) {
+	switch method := os.Getenv("REPO_UPDATE_METHOD"); method {
+	case "api":
+		if commitSigningConfigured() {
+			return "", fmt.Errorf("COMMIT_SIGNING_KEY can only sign commits made with REPO_UPDATE_METHOD clone, use REQUIRE_SIGNED_COMMITS to have Github sign API commits instead")
+		}
+		return method, nil
+	case "clone":
+		return method, nil
+	case "":
+		if _, _, ok := parseGithubRepo(target.RepoURL); ok && !target.PushToFork && target.AssetsBranch == "" && !commitSigningConfigured() {
+			return "api", nil
+		}
+		return "clone", nil
+	default:
+		return "", fmt.Errorf("REPO_UPDATE_METHOD must be api or clone, got: %s", method)
+	}
+}
+
+// parseGithubRepo extracts the owner and repository name from a github.com clone URL
+func parseGithubRepo(repoURL string) (string, string, bool) {
+	parsed, err := url.Parse(repoURL)
+	if err != nil || parsed.Host != "github.com" {
+		return "", "", false
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimSuffix(parsed.Path, ".git"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// readRepoFile reads the contents of filePath on the given branch of the Github repository. It reports false, without an error,
+// if the file does not exist in the repository
+func readRepoFile(githubClient *github.Client, owner, repo, branch, filePath string) ([]byte, bool, error) {
+	fileContent, _, resp, err := githubClient.Repositories.GetContents(context.Background(), owner, repo, filePath, &github.RepositoryContentGetOptions{Ref: branch})
+	if resp != nil && resp.StatusCode == 404 {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if fileContent == nil {
+		return nil, false, fmt.Errorf("%s is a directory in %s/%s", filePath, owner, repo)
+	}
+
+	contents, err := fileContent.GetContent()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return []byte(contents), true, nil
+}
+
+// downloadRepoFile writes the contents of filePath on the given branch of the Github repository to destPath. It reports false,
+// without an error, if the file does not exist in the repository
+func downloadRepoFile(githubClient *github.Client, owner, repo, branch, filePath, destPath string) (bool, error) {
+	contents, found, err := readRepoFile(githubClient, owner, repo, branch, filePath)
+	if err != nil || !found {
+		return false, err
+	}
+
+	return true, ioutil.WriteFile(destPath, contents, 0644)
+}
+
+// commitBadgeViaAPI creates a commit on top of baseBranch that writes the given files to branch, without cloning the repository:
+// 1. Look up the commit at the tip of the base branch, and the tree it points to
+// 2. Upload each file as a blob
+// 3. Create a tree on top of the base commit's tree that swaps in the new blobs at the files' paths
+// 4. Create a commit of that tree whose parent is the base commit
+// 5. Point the branch ref at the commit, creating the branch or force-updating it if a previous run this month already created it.
+// When committing directly to the base branch, the ref is only ever fast-forwarded
+// It returns the SHA of the new commit
+func commitBadgeViaAPI(githubClient *github.Client, owner, repo, baseBranch, branch, message string, files []RepoFile) (string, error) {
+	ctx := context.Background()
+
+	baseRef, _, err := githubClient.Git.GetRef(ctx, owner, repo, "refs/heads/"+baseBranch)
+	if err != nil {
+		return "", err
+	}
+
+	baseCommit, _, err := githubClient.Git.GetCommit(ctx, owner, repo, baseRef.GetObject().GetSHA())
+	if err != nil {
+		return "", err
+	}
+
+	entries := []*github.TreeEntry{}
+	for _, file := range files {
+		blob, _, err := githubClient.Git.CreateBlob(ctx, owner, repo, &github.Blob{
+			Content:  github.String(base64.StdEncoding.EncodeToString(file.Contents)),
+			Encoding: github.String("base64"),
+		})
+		if err != nil {
+			return "", err
+		}
+
+		entries = append(entries, &github.TreeEntry{
+			Path: github.String(file.Path),
+			Mode: github.String("100644"),
+			Type: github.String("blob"),
+			SHA:  blob.SHA,
+		})
+	}
+
+	tree, _, err := githubClient.Git.CreateTree(ctx, owner, repo, baseCommit.GetTree().GetSHA(), entries)
+	if err != nil {
+		return "", err
+	}
+
+	newCommit := &github.Commit{
+		Message: github.String(message),
+		Tree:    tree,
+		Parents: []*github.Commit{{SHA: baseCommit.SHA}},
+	}
+
+	// Github only signs commits made through the API with its web-flow key when it sets the author itself, so the custom
+	// author is left off for repositories that require signed commits
+	if !getEnvBool("REQUIRE_SIGNED_COMMITS") {
+		now := time.Now()
+		newCommit.Author = &github.CommitAuthor{
+			Name:  github.String("Zack Proser"),
+			Email: github.String("zackproser@gmail.com"),
+			Date:  &now,
+		}
+	}
+
+	commit, _, err := githubClient.Git.CreateCommit(ctx, owner, repo, newCommit)
+	if err != nil {
+		return "", err
+	}
+
+	if getEnvBool("REQUIRE_SIGNED_COMMITS") && !commit.GetVerification().GetVerified() {
+		return "", fmt.Errorf("Github did not sign commit %s (reason: %s), so it would be rejected by branch protection. Signed API commits require authenticating as a Github App with GITHUB_APP_ID",
+			commit.GetSHA(), commit.GetVerification().GetReason())
+	}
+
+	branchRef := &github.Reference{
+		Ref:    github.String("refs/heads/" + branch),
+		Object: &github.GitObject{SHA: commit.SHA},
+	}
+
+	_, resp, err := githubClient.Git.GetRef(ctx, owner, repo, branchRef.GetRef())
+	switch {
+	case err == nil:
+		_, _, err = githubClient.Git.UpdateRef(ctx, owner, repo, branchRef, branch != baseBranch)
+	case resp != nil && resp.StatusCode == 404:
+		_, _, err = githubClient.Git.CreateRef(ctx, owner, repo, branchRef)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Printf("Created commit %s on branch %s via the Github API\n", commit.GetSHA(), branch)
+
+	return commit.GetSHA(), nil
+}
+
+// updateBadgeImageViaAPI updates the badge in the target repository, such as my Github profile, entirely through the Github API, which avoids cloning the
+// profile repository and its full image history into the Lambda's /tmp directory:
+// 1. Download the badge currently on the base branch and compare it with the new badge, stopping if they differ by more than
+// a monthly update would
+// 2. Render every output of the target and compare it with the file on the base branch, stopping if none of them changed
+// 3. Commit the changed files through the Git Data API, to the month's branch, or straight to the base branch in direct mode
+// 4. Open a Pull Request of that branch against the base branch, or refresh the one that is already open, then merge it or
+// request reviewers as the delivery mode requires
+func updateBadgeImageViaAPI(store ArtifactStore, run *Run, target *Target, owner, repo string) (DeliveryResult, error) {
+	githubClient, clientErr := getGithubClient(owner, repo, target.GithubAppInstallationID)
+
+	if clientErr != nil {
+		return DeliveryResult{}, clientErr
+	}
+
+	found, downloadErr := downloadRepoFile(githubClient, owner, repo, target.BaseBranch, primaryBadgePath(target.Outputs), target.previousBadgePath())
+
+	if downloadErr != nil {
+		return DeliveryResult{}, downloadErr
+	}
+
+	if !found {
+		// Make sure a badge left behind by an earlier invocation of this Lambda container isn't compared against
+		os.Remove(target.previousBadgePath())
+	}
+
+	visualErr := checkVisualRegression(store, run, target)
+
+	if visualErr != nil {
+		return DeliveryResult{}, visualErr
+	}
+
+	// Each file on the base branch is fetched once, both to render README regions and to work out what changed
+	type existingFile struct {
+		contents []byte
+		found    bool
+	}
+	existingFiles := map[string]existingFile{}
+	readExisting := func(filePath string) ([]byte, bool, error) {
+		if existing, ok := existingFiles[filePath]; ok {
+			return existing.contents, existing.found, nil
+		}
+		contents, found, err := readRepoFile(githubClient, owner, repo, target.BaseBranch, filePath)
+		if err != nil {
+			return nil, false, err
+		}
+		existingFiles[filePath] = existingFile{contents, found}
+		return contents, found, nil
+	}
+
+	files, renderErr := renderOutputs(target.Outputs, run, readExisting)
+
+	if renderErr != nil {
+		return DeliveryResult{}, renderErr
+	}
+
+	// Only the files that differ from the base branch go into the commit
+	changedFiles := []RepoFile{}
+	changes := []FileChange{}
+	for _, file := range files {
+		existing, found, readErr := readExisting(file.Path)
+		if readErr != nil {
+			return DeliveryResult{}, readErr
+		}
+
+		status := fileStatus(file.Contents, existing, found)
+		changes = append(changes, FileChange{Path: file.Path, Status: status})
+		if status != FILE_UNCHANGED {
+			changedFiles = append(changedFiles, file)
+		}
+	}
+
+	logFileChanges(changes)
+
+	if !hasChanges(changes) {
+		return DeliveryResult{Files: changes}, nil
+	}
+
+	message, messageErr := badgeCommitMessage(run, target)
+
+	if messageErr != nil {
+		return DeliveryResult{}, messageErr
+	}
+
+	if target.Mode == DELIVERY_DIRECT {
+		sha, commitErr := commitBadgeViaAPI(githubClient, owner, repo, target.BaseBranch, target.BaseBranch, message, changedFiles)
+		return DeliveryResult{CommitSHA: sha, Merged: true, Files: changes}, commitErr
+	}
+
+	branch, branchErr := badgeBranchName(run, target)
+
+	if branchErr != nil {
+		return DeliveryResult{}, branchErr
+	}
+
+	sha, commitErr := commitBadgeViaAPI(githubClient, owner, repo, target.BaseBranch, branch, message, changedFiles)
+
+	if commitErr != nil {
+		return DeliveryResult{}, commitErr
+	}
+
+	forge := newGithubForge(githubClient, owner, repo, target.BaseBranch)
+
+	pr, prErr := openOrUpdatePullRequest(forge, store, run, target, nil, branch)
+
+	if prErr != nil {
+		return DeliveryResult{}, prErr
+	}
+
+	result, finishErr := finishPullRequest(forge, pr, sha, target)
+	result.Files = changes
+	return result, finishErr
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+)
+
+const (
+	// GITHUB_APP_JWT_LIFETIME is how long the JWT identifying the Github App is valid for. Github rejects JWTs that expire more
+	// than 10 minutes after they were issued
+	GITHUB_APP_JWT_LIFETIME = 9 * time.Minute
+	// GITHUB_APP_JWT_CLOCK_SKEW backdates the JWT's issue time, in case the Lambda's clock is ahead of Github's
+	GITHUB_APP_JWT_CLOCK_SKEW = 60 * time.Second
+	// GITHUB_APP_TOKEN_USERNAME is the username git authenticates with when using an installation token as its password
+	GITHUB_APP_TOKEN_USERNAME = "x-access-token"
+	// INSTALLATION_TOKEN_MIN_LIFETIME is how long a cached installation token must remain valid for to be reused
+	INSTALLATION_TOKEN_MIN_LIFETIME = 5 * time.Minute
+)
+
+// ForgeCredentials are what both a forge's API and git pushes authenticate with: a token, and the username git presents it as
+// the password of
+type ForgeCredentials struct {
+	Username string
+	Token    string
+}
+
+// installationTokens caches the installation token minted for each owner/repo, since a single run authenticates to the same
+// repository several times
+var (
+	installationTokens   = map[string]*github.InstallationToken{}
+	installationTokensMu sync.Mutex
+)
+
+// githubAppConfigured reports whether the function authenticates as a Github App, rather than with a personal access token
+func githubAppConfigured() bool {
+	return os.Getenv("GITHUB_APP_ID") != ""
+}
+
+// getGithubCredentials returns the credentials used to update the owner/repo repository. When GITHUB_APP_ID is set, this is an
+// installation token minted for that repository alone, so writes are limited to the repositories the app is installed on.
+// Otherwise it is the GITHUB_OAUTH_TOKEN personal access token, presented as the REPO_OWNER user. installationID names the
+// app's installation on the repository, or is 0 to look it up
+func getGithubCredentials(owner, repo string, installationID int64) (ForgeCredentials, error) {
+	if githubAppConfigured() {
+		token, err := getInstallationToken(owner, repo, installationID)
+		if err != nil {
+			return ForgeCredentials{}, err
+		}
+		return ForgeCredentials{Username: GITHUB_APP_TOKEN_USERNAME, Token: token}, nil
+	}
+
+	if os.Getenv("GITHUB_OAUTH_TOKEN") == "" {
+		return ForgeCredentials{}, errors.New("You must set either the GITHUB_APP_ID env var to authenticate as a Github App, or the GITHUB_OAUTH_TOKEN env var to a valid Github personal access token")
+	}
+
+	return ForgeCredentials{Username: os.Getenv("REPO_OWNER"), Token: os.Getenv("GITHUB_OAUTH_TOKEN")}, nil
+}
+
+// getGithubAppPrivateKey returns the Github App's private key, read either directly from the GITHUB_APP_PRIVATE_KEY env var, or
+// from the AWS Secrets Manager secret named by GITHUB_APP_PRIVATE_KEY_SECRET_ID
+func getGithubAppPrivateKey() (*rsa.PrivateKey, error) {
+	pemKey := os.Getenv("GITHUB_APP_PRIVATE_KEY")
+
+	if pemKey == "" {
+		secretID := os.Getenv("GITHUB_APP_PRIVATE_KEY_SECRET_ID")
+		if secretID == "" {
+			return nil, errors.New("Authenticating as a Github App requires the GITHUB_APP_PRIVATE_KEY or GITHUB_APP_PRIVATE_KEY_SECRET_ID env var")
+		}
+
+		var err error
+		pemKey, err = getSecretString(secretID)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading Github App private key from secret %s: %v", secretID, err)
+		}
+	}
+
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errors.New("The Github App private key must be PEM encoded")
+	}
+
+	// Github issues PKCS#1 keys, but a key converted to PKCS#8 works just as well
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing Github App private key: %v", err)
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("The Github App private key must be an RSA key")
+	}
+
+	return key, nil
+}
+
+// githubAppJWT creates the RS256 signed JWT that identifies the Github App when minting installation tokens
+func githubAppJWT(appID string, key *rsa.PrivateKey, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-GITHUB_APP_JWT_CLOCK_SKEW).Unix(),
+		"exp": now.Add(GITHUB_APP_JWT_LIFETIME).Unix(),
+		"iss": appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// bearerTransport authenticates every request with a bearer token, which is how the Github App's JWT is presented
+type bearerTransport struct {
+	token string
+}
+
+// RoundTrip adds the Authorization header to a copy of the request, as http.RoundTripper implementations must not modify it
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	authenticated := req.Clone(req.Context())
+	authenticated.Header.Set("Authorization", "Bearer "+t.token)
+	return http.DefaultTransport.RoundTrip(authenticated)
+}
+
+// getInstallationToken mints a short-lived installation token for the owner/repo repository:
+// 1. Sign a JWT with the app's private key, identifying the app by GITHUB_APP_ID
+// 2. Look up the app's installation on the repository, unless the target names it with installationID
+// 3. Create an installation token restricted to that one repository
+// Tokens are cached for the rest of the invocation, and replaced when they are close to expiring
+func getInstallationToken(owner, repo string, installationID int64) (string, error) {
+	installationTokensMu.Lock()
+	defer installationTokensMu.Unlock()
+
+	cacheKey := owner + "/" + repo
+	if cached, ok := installationTokens[cacheKey]; ok && time.Until(cached.GetExpiresAt()) > INSTALLATION_TOKEN_MIN_LIFETIME {
+		return cached.GetToken(), nil
+	}
+
+	key, err := getGithubAppPrivateKey()
+	if err != nil {
+		return "", err
+	}
+
+	jwt, err := githubAppJWT(os.Getenv("GITHUB_APP_ID"), key, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	appClient := github.NewClient(&http.Client{Transport: &bearerTransport{token: jwt}})
+
+	installationID, err = getInstallationID(ctx, appClient, owner, repo, installationID)
+	if err != nil {
+		return "", err
+	}
+
+	// go-github only restricts installation tokens by repository ID, which can't be looked up without a token, so the
+	// repository is named in the request directly
+	body := struct {
+		Repositories []string `json:"repositories"`
+	}{Repositories: []string{repo}}
+
+	req, err := appClient.NewRequest("POST", fmt.Sprintf("app/installations/%d/access_tokens", installationID), body)
+	if err != nil {
+		return "", err
+	}
+
+	token := &github.InstallationToken{}
+	if _, err := appClient.Do(ctx, req, token); err != nil {
+		return "", fmt.Errorf("Error creating Github App installation token for %s: %v", cacheKey, err)
+	}
+
+	installationTokens[cacheKey] = token
+
+	fmt.Printf("Created Github App installation token for %s, expiring at %s\n", cacheKey, token.GetExpiresAt().Format(time.RFC3339))
+
+	return token.GetToken(), nil
+}
+
+// getInstallationID returns the ID of the Github App's installation that covers the owner/repo repository, which is configured
+// when configured isn't 0 and looked up otherwise
+func getInstallationID(ctx context.Context, appClient *github.Client, owner, repo string, configured int64) (int64, error) {
+	if configured != 0 {
+		return configured, nil
+	}
+
+	installation, resp, err := appClient.Apps.FindRepositoryInstallation(ctx, owner, repo)
+	if resp != nil && resp.StatusCode == 404 {
+		return 0, fmt.Errorf("The Github App %s is not installed on %s/%s", os.Getenv("GITHUB_APP_ID"), owner, repo)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return installation.GetID(), nil
+}
@@ -8,17 +8,55 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	// DEFAULT_BADGE_HTML_URL_TTL is how long the presigned badge HTML URL handed to HCTI stays valid when
+	// BADGE_HTML_URL_TTL_MINUTES is not set. HCTI fetches the page as soon as the request is made, so this can be short
+	DEFAULT_BADGE_HTML_URL_TTL = 15 * time.Minute
+)
+
+// badgeHTMLURL returns the URL the renderer should fetch the badge HTML page from. By default this is a short-lived presigned
+// URL, so the bucket doesn't need to be public. Setting BADGE_HTML_ACCESS=public restores the legacy behavior of passing the
+// object's public URL, which relies on the bucket's public read policy. BADGE_HTML_ACCESS=inline returns no URL at all, so the
+// page is sent to HCTI with the request, which is needed when the store (such as a local MinIO) can't be reached from the internet
+func badgeHTMLURL(store ArtifactStore, key string) (string, error) {
+	switch os.Getenv("BADGE_HTML_ACCESS") {
+	case "", "presigned":
+	case "public":
+		return store.URL(key), nil
+	case "inline":
+		return "", nil
+	default:
+		return "", fmt.Errorf("BADGE_HTML_ACCESS must be presigned, public or inline, got: %s", os.Getenv("BADGE_HTML_ACCESS"))
+	}
+
+	presigner, ok := store.(PresignedURLStore)
+	if !ok {
+		// Local and in-memory stores have nothing to presign, and their badge HTML is sent to HCTI inline instead
+		return store.URL(key), nil
+	}
+
+	ttlMinutes, err := getEnvInt("BADGE_HTML_URL_TTL_MINUTES", int(DEFAULT_BADGE_HTML_URL_TTL/time.Minute))
+	if err != nil {
+		return "", err
+	}
+
+	url, _, err := presigner.PresignedURL(key, time.Duration(ttlMinutes)*time.Minute)
+	return url, err
+}
+
 // HCTIResponse represents the format of the response from the image-resizing API, which will return a single field: "url"
 type HCTIResponse struct {
 	URL string `json:"url"`
 }
 
-// resizePostedBadge makes an API call to the HCTI API, passing it the URL of the S3-hosted badge.html file
+// resizePostedBadge makes an API call to the HCTI API, passing it the URL of the hosted badge.html file
 // HCTI will return a URL at which it is hosting the extracted badge image
-func resizePostedBadge() (string, error) {
+func resizePostedBadge(badgeHTMLURL string) (string, error) {
 	// Sanity-check that the required HCTI env vars are set
 	if os.Getenv("HCTI_USER_ID") == "" || os.Getenv("HCTI_API_KEY") == "" {
 		return "", errors.New("HCTI_USER_ID and HCTI_API_KEY env vars are required")
@@ -26,13 +64,24 @@ func resizePostedBadge() (string, error) {
 
 	// Set parameters to pass to the HCTI API
 	data := map[string]string{
-		// S3_BADGE_HTML_PUBLIC_URL is the fully-qualified URL to the public S3 HTML page containing the modified badge HTML
-		"url":             S3_BADGE_HTML_PUBLIC_URL,
-		"viewport_width":  "300",
-		"viewport_height": "117",
+		"viewport_width":  strconv.Itoa(defaultTheme.Width),
+		"viewport_height": strconv.Itoa(defaultTheme.Height),
 		"selector":        ".container",
 	}
 
+	if strings.HasPrefix(badgeHTMLURL, "http://") || strings.HasPrefix(badgeHTMLURL, "https://") {
+		// badgeHTMLURL is the fully-qualified URL to the hosted HTML page containing the modified badge HTML
+		data["url"] = badgeHTMLURL
+	} else {
+		// Artifacts stored locally, in memory or on a private network can't be fetched by HCTI, so send the page's HTML along
+		// with the request instead
+		badgeHTML, readErr := ioutil.ReadFile(BADGE_LOCAL_PATH)
+		if readErr != nil {
+			return "", readErr
+		}
+		data["html"] = string(badgeHTML)
+	}
+
 	reqBody, err := json.Marshal(data)
 	if err != nil {
 		return "", err
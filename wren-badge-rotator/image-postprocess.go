@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"sort"
+)
+
+const (
+	// TRIM_COLOR_TOLERANCE is how far (per channel) a pixel can drift from the border color and still be trimmed away
+	TRIM_COLOR_TOLERANCE = 8
+	// DEFAULT_BADGE_PALETTE_SIZE is the number of colors the badge is quantized to when BADGE_PALETTE_SIZE is not set. The badge
+	// is a handful of flat colors plus anti-aliased text, so 64 colors is visually lossless while keeping the PNG small
+	DEFAULT_BADGE_PALETTE_SIZE = 64
+)
+
+// PostProcessOptions controls how the badge image returned by HCTI is cleaned up before it is published
+type PostProcessOptions struct {
+	// Padding is the number of transparent pixels added around every edge of the badge
+	Padding int
+	// CornerRadius rounds the corners of the badge by the given number of pixels
+	CornerRadius int
+	// PaletteSize is the maximum number of colors in the re-encoded PNG, 0 disables quantization
+	PaletteSize int
+}
+
+// getPostProcessOptions reads the post-processing options from the BADGE_PADDING, BADGE_CORNER_RADIUS and BADGE_PALETTE_SIZE env vars
+func getPostProcessOptions() (PostProcessOptions, error) {
+	padding, err := getEnvInt("BADGE_PADDING", 0)
+	if err != nil {
+		return PostProcessOptions{}, err
+	}
+
+	cornerRadius, err := getEnvInt("BADGE_CORNER_RADIUS", 0)
+	if err != nil {
+		return PostProcessOptions{}, err
+	}
+
+	paletteSize, err := getEnvInt("BADGE_PALETTE_SIZE", DEFAULT_BADGE_PALETTE_SIZE)
+	if err != nil {
+		return PostProcessOptions{}, err
+	}
+
+	if paletteSize > 256 {
+		return PostProcessOptions{}, fmt.Errorf("BADGE_PALETTE_SIZE must be at most 256, got: %d", paletteSize)
+	}
+
+	return PostProcessOptions{
+		Padding:      padding,
+		CornerRadius: cornerRadius,
+		PaletteSize:  paletteSize,
+	}, nil
+}
+
+// postProcessBadgeImage rewrites the badge image at imagePath in place: it trims any stray border around the badge, rounds its
+// corners, pads it, quantizes it to a small palette and re-encodes it with the best PNG compression, so the image committed to
+// the profile repository every month stays small
+func postProcessBadgeImage(imagePath string, theme BadgeTheme, opts PostProcessOptions) error {
+	img, err := decodePNG(imagePath)
+	if err != nil {
+		return err
+	}
+
+	background, err := parseHexColor(theme.BackgroundColor)
+	if err != nil {
+		return err
+	}
+
+	badge := trimBorder(img, background)
+	badge = roundCorners(badge, opts.CornerRadius)
+	badge = addPadding(badge, opts.Padding)
+
+	var processed image.Image = badge
+
+	if opts.PaletteSize > 0 {
+		processed = quantize(processed, opts.PaletteSize)
+	}
+
+	file, err := os.Create(imagePath)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	encoder := &png.Encoder{CompressionLevel: png.BestCompression}
+
+	return encoder.Encode(file, processed)
+}
+
+// trimBorder removes any uniformly colored rows and columns around the edges of the image, such as the page margin surrounding
+// .container. The border color is taken from the top left pixel, and nothing is trimmed when that pixel already belongs to the
+// badge's background, since that means the badge fills the image edge to edge
+func trimBorder(img image.Image, background color.RGBA) *image.RGBA {
+	bounds := img.Bounds()
+	border := color.RGBAModel.Convert(img.At(bounds.Min.X, bounds.Min.Y)).(color.RGBA)
+
+	crop := bounds
+	if !colorsWithinTolerance(border, background, TRIM_COLOR_TOLERANCE) {
+		crop = image.Rectangle{Min: bounds.Max, Max: bounds.Min}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+				if colorsWithinTolerance(c, border, TRIM_COLOR_TOLERANCE) {
+					continue
+				}
+				crop = crop.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+		// The whole image is the border color, there is nothing to trim to
+		if crop.Empty() {
+			crop = bounds
+		}
+	}
+
+	trimmed := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	draw.Draw(trimmed, trimmed.Bounds(), img, crop.Min, draw.Src)
+
+	return trimmed
+}
+
+// roundCorners makes the pixels outside a circle of the given radius at each corner of the image transparent
+func roundCorners(img *image.RGBA, radius int) *image.RGBA {
+	bounds := img.Bounds()
+	if radius <= 0 || radius*2 > bounds.Dx() || radius*2 > bounds.Dy() {
+		return img
+	}
+
+	for y := 0; y < radius; y++ {
+		for x := 0; x < radius; x++ {
+			dx := radius - x
+			dy := radius - y
+			if dx*dx+dy*dy <= radius*radius {
+				continue
+			}
+			// Mirror the pixel outside the arc to all four corners
+			img.Set(bounds.Min.X+x, bounds.Min.Y+y, color.Transparent)
+			img.Set(bounds.Max.X-1-x, bounds.Min.Y+y, color.Transparent)
+			img.Set(bounds.Min.X+x, bounds.Max.Y-1-y, color.Transparent)
+			img.Set(bounds.Max.X-1-x, bounds.Max.Y-1-y, color.Transparent)
+		}
+	}
+
+	return img
+}
+
+// addPadding surrounds the image with the given number of transparent pixels on every side
+func addPadding(img *image.RGBA, padding int) *image.RGBA {
+	if padding <= 0 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	padded := image.NewRGBA(image.Rect(0, 0, bounds.Dx()+padding*2, bounds.Dy()+padding*2))
+	draw.Draw(padded, bounds.Sub(bounds.Min).Add(image.Pt(padding, padding)), img, bounds.Min, draw.Src)
+
+	return padded
+}
+
+// quantize reduces the image to at most paletteSize colors, keeping the most frequently used colors and mapping every other
+// pixel to its nearest palette entry. Dithering is deliberately skipped, since it adds noise to the badge's flat colors and text
+func quantize(img image.Image, paletteSize int) *image.Paletted {
+	bounds := img.Bounds()
+	counts := map[color.RGBA]int{}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			counts[color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)]++
+		}
+	}
+
+	colors := make([]color.RGBA, 0, len(counts))
+	for c := range counts {
+		colors = append(colors, c)
+	}
+
+	sort.Slice(colors, func(i, j int) bool {
+		if counts[colors[i]] != counts[colors[j]] {
+			return counts[colors[i]] > counts[colors[j]]
+		}
+		// Break ties deterministically so the same input always produces the same PNG bytes
+		return rgbaKey(colors[i]) < rgbaKey(colors[j])
+	})
+
+	if len(colors) > paletteSize {
+		colors = colors[:paletteSize]
+	}
+
+	palette := make(color.Palette, len(colors))
+	for i, c := range colors {
+		palette[i] = c
+	}
+
+	paletted := image.NewPaletted(image.Rect(0, 0, bounds.Dx(), bounds.Dy()), palette)
+	draw.Draw(paletted, paletted.Bounds(), img, bounds.Min, draw.Src)
+
+	return paletted
+}
+
+// rgbaKey packs a color into a single integer for ordering
+func rgbaKey(c color.RGBA) uint32 {
+	return uint32(c.R)<<24 | uint32(c.G)<<16 | uint32(c.B)<<8 | uint32(c.A)
+}
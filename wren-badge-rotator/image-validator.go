@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/png"
+	"os"
+)
+
+const (
+	// MIN_DISTINCT_COLORS is the fewest colors a rendered badge can contain - the text, divider and tons pill guarantee more than this
+	MIN_DISTINCT_COLORS = 3
+	// MAX_TRANSPARENT_RATIO is the largest share of fully transparent pixels tolerated before the image is considered empty
+	MAX_TRANSPARENT_RATIO = 0.1
+	// MIN_BACKGROUND_RATIO is the smallest share of pixels that must match the theme's background color
+	MIN_BACKGROUND_RATIO = 0.5
+	// BACKGROUND_COLOR_TOLERANCE is how far (per channel) a pixel can drift from the background color and still count towards it,
+	// which absorbs anti-aliasing and compression noise
+	BACKGROUND_COLOR_TOLERANCE = 8
+)
+
+// validateBadgeImage decodes the image at imagePath and makes sure it looks like a correctly rendered badge before it is
+// published anywhere: once the page margin HCTI renders around it is trimmed away, exactly as post-processing trims it, it must
+// be a PNG of exactly the theme's dimensions, it must not be blank, a single color or transparent, and the theme's background
+// color must be the dominant color in the badge
+func validateBadgeImage(imagePath string, theme BadgeTheme) error {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	decoded, format, err := image.Decode(file)
+	if err != nil {
+		return fmt.Errorf("Extracted badge is not a decodable image: %v", err)
+	}
+
+	if format != "png" {
+		return fmt.Errorf("Extracted badge has format %s, expected png", format)
+	}
+
+	background, err := parseHexColor(theme.BackgroundColor)
+	if err != nil {
+		return err
+	}
+
+	// Check the badge itself, as post-processing will trim it, rather than the page margin around it
+	img := trimBorder(decoded, background)
+
+	bounds := img.Bounds()
+	if bounds.Dx() != theme.Width || bounds.Dy() != theme.Height {
+		return fmt.Errorf("Extracted badge is %dx%d once trimmed, expected %dx%d", bounds.Dx(), bounds.Dy(), theme.Width, theme.Height)
+	}
+
+	colorCounts := map[color.RGBA]int{}
+	transparentPixels := 0
+	backgroundPixels := 0
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			colorCounts[c]++
+			if c.A == 0 {
+				transparentPixels++
+			}
+			if colorsWithinTolerance(c, background, BACKGROUND_COLOR_TOLERANCE) {
+				backgroundPixels++
+			}
+		}
+	}
+
+	totalPixels := bounds.Dx() * bounds.Dy()
+
+	if len(colorCounts) < MIN_DISTINCT_COLORS {
+		return fmt.Errorf("Extracted badge contains only %d distinct colors, it is likely blank", len(colorCounts))
+	}
+
+	if float64(transparentPixels)/float64(totalPixels) > MAX_TRANSPARENT_RATIO {
+		return fmt.Errorf("Extracted badge is %d%% transparent, it is likely blank", transparentPixels*100/totalPixels)
+	}
+
+	if float64(backgroundPixels)/float64(totalPixels) < MIN_BACKGROUND_RATIO {
+		return fmt.Errorf("Only %d%% of the extracted badge matches the %s background color %s, the styling was likely not applied",
+			backgroundPixels*100/totalPixels, theme.Name, theme.BackgroundColor)
+	}
+
+	return nil
+}
+
+// colorsWithinTolerance reports whether every channel of a and b differs by no more than tolerance
+func colorsWithinTolerance(a, b color.RGBA, tolerance int) bool {
+	return absDiff(a.R, b.R) <= tolerance &&
+		absDiff(a.G, b.G) <= tolerance &&
+		absDiff(a.B, b.B) <= tolerance &&
+		absDiff(a.A, b.A) <= tolerance
+}
+
+// absDiff returns the absolute difference between two color channel values
+func absDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
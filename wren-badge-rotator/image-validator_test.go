@@ -0,0 +1,63 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestBadge writes a PNG of a width x height badge in the theme's background color, with a stripe of text and a divider,
+// centered in a white page margin of the given size
+func writeTestBadge(t *testing.T, width, height, margin int) string {
+	background, err := parseHexColor(defaultTheme.BackgroundColor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width+margin*2, height+margin*2))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	badge := image.Rect(margin, margin, margin+width, margin+height)
+	draw.Draw(img, badge, image.NewUniform(background), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(margin+10, margin+10, margin+60, margin+20), image.NewUniform(color.Black), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(margin+10, margin+30, margin+60, margin+32), image.NewUniform(color.RGBA{R: 0xee, G: 0xee, B: 0xee, A: 0xff}), image.Point{}, draw.Src)
+
+	imagePath := filepath.Join(t.TempDir(), "badge.png")
+	file, err := os.Create(imagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if err := png.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+	return imagePath
+}
+
+func TestValidateBadgeImageDimensions(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		margin        int
+		wantErr       bool
+	}{
+		{name: "exact size", width: defaultTheme.Width, height: defaultTheme.Height},
+		{name: "exact size in a page margin", width: defaultTheme.Width, height: defaultTheme.Height, margin: 8},
+		{name: "a pixel too wide", width: defaultTheme.Width + 1, height: defaultTheme.Height, margin: 8, wantErr: true},
+		{name: "a pixel too short", width: defaultTheme.Width, height: defaultTheme.Height - 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBadgeImage(writeTestBadge(t, tt.width, tt.height, tt.margin), defaultTheme)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateBadgeImage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -22,18 +24,16 @@ var (
 	S3_BUCKET = os.Getenv("S3_BUCKET")
 	// BADGE_LOCAL_PATH is the path in the lambda execution environment where we will temporarily write the HTML page containing our modifified CSS
 	BADGE_LOCAL_PATH = "/tmp/badge.html"
-	// HTML_PAGE_DEST_S3_PATH is the path in S3 where the modified badge HTML page will be written
-	HTML_PAGE_DEST_S3_PATH = "badge.html"
 	// EXTRACTED_BADGE_IMAGE_LOCAL_PATH is the path where the image returned by the HTCI API will be written, prior to be uploaded to S3
 	EXTRACTED_BADGE_IMAGE_LOCAL_PATH = "/tmp/extracted-badge.png"
-	// EXTRACTED_BADGE_IMAGE_S3_PATH is the path in S3 where the updated and extracted badge image will be written for debugging and testing purposes (it is not used directly)
-	EXTRACTED_BADGE_IMAGE_S3_PATH = "/extracted/badge.png"
-	// S3_BADGE_PATH is the S3 bucket address to the public HTML page - that can be provided to the HCTI API for image extraction
-	S3_BADGE_HTML_PUBLIC_URL = fmt.Sprintf("https://%s.s3.amazonaws.com/badge.html", S3_BUCKET)
 	// HCTI_API_URL is the URL to the API that converts HTML and CSS to a static image
 	HCTI_API_URL = "https://hcti.io/v1/image"
-	// REPO_URL points to the special repo that stylizes my Github profile
-	REPO_URL = "https://github.com/zackproser/zackproser.git"
+	// REPO_URL points to the special repo that stylizes my Github profile. The REPO_URL env var points it at a profile repository
+	// on another forge, such as GitLab or Gitea
+	REPO_URL = getEnvString("REPO_URL", "https://github.com/zackproser/zackproser.git")
+	// VERSION is the version of this tool, recorded in the metadata of every badge it produces. It is overridden at build time
+	// via -ldflags "-X main.VERSION=..."
+	VERSION = "dev"
 )
 
 // handler is the entrypoint called by Lambda when it is triggered by our CloudWatch event or a manual test or invocation
@@ -41,13 +41,41 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 	err := sanityCheckEnvVars()
 	if err != nil {
 		return events.APIGatewayProxyResponse{
-				Body:       "You must define HCTI_API_KEY, HCTI_USER_NAME, and GITHUB_OAUTH_TOKEN env vars",
+				Body:       "You must define HCTI_API_KEY, HCTI_USER_NAME, and either GITHUB_OAUTH_TOKEN, GITHUB_APP_ID, GITLAB_TOKEN, GITEA_TOKEN or GIST_TOKEN env vars",
 				StatusCode: 400,
 			},
 			nil
 	}
 
+	// Work out every repository the badge is delivered to up front, so a configuration mistake fails before anything is rendered
+	targets, targetsErr := getTargets()
+	if targetsErr != nil {
+		return events.APIGatewayProxyResponse{
+				Body:       fmt.Sprintf("Error reading badge targets: %+v\n", targetsErr),
+				StatusCode: 400,
+			},
+			nil
+	}
+
+	// Every artifact produced during the run is written through the artifact store, which is S3 unless configured otherwise
+	store, storeErr := newArtifactStore()
+	if storeErr != nil {
+		return events.APIGatewayProxyResponse{
+				Body:       fmt.Sprintf("Error creating artifact store: %+v\n", storeErr),
+				StatusCode: 500,
+			},
+			nil
+	}
+
 	// Fetch the raw HTML of the page that hosts my Wren.co badge
+	scrapedAt := time.Now()
+	run, runErr := newRun(scrapedAt, os.Getenv("WREN_USERNAME"))
+	if runErr != nil {
+		return events.APIGatewayProxyResponse{}, runErr
+	}
+
+	fmt.Printf("Starting run %s\n", run.ID)
+
 	resp, err := http.Get(WrenBadgeURL)
 	if err != nil {
 		return events.APIGatewayProxyResponse{}, err
@@ -65,6 +93,12 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 		return events.APIGatewayProxyResponse{}, err
 	}
 
+	// Archive the original Wren page, so the badge can be traced back to exactly what was scraped
+	sourceErr := run.archiveArtifact(store, ARTIFACT_SOURCE_HTML, bytes.NewReader(b))
+	if sourceErr != nil {
+		fmt.Printf("Error archiving source HTML: %+v\n", sourceErr)
+	}
+
 	// Convert the raw bytes of the HTTP response to a string, and feed that string into the HTML parse function
 	// so that we're left with an HTML node entity that can be passed into our badge function
 	doc, _ := html.Parse(strings.NewReader(string(b)))
@@ -79,6 +113,19 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 			nil
 	}
 
+	run.Stats = extractBadgeStats(bn)
+
+	// Record where this badge came from, so it can be embedded in the final badge image
+	provenance := BadgeProvenance{
+		SourceURL: WrenBadgeURL,
+		ScrapedAt: scrapedAt,
+		RunID:     run.ID,
+		Stats:     run.Stats,
+		Theme:     defaultTheme.Name,
+		Renderer:  RENDERER_NAME,
+		Version:   VERSION,
+	}
+
 	badge := BadgeHTML{
 		Contents: renderNode(bn),
 	}
@@ -112,19 +159,32 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 			nil
 	}
 
-	// Upload the modified HTML file containing the re-styled badge to S3
-	uploadErr := uploadHTMLBadgeToS3()
+	// Close the badge HTML file so that it is fully written before it is uploaded
+	bfh.Close()
+
+	// Upload the modified HTML file containing the re-styled badge to the artifact store
+	uploadErr := uploadHTMLBadge(store, run)
 	if uploadErr != nil {
-		fmt.Printf("Error uploading modified HTML file to S3 bucket: %+b\n", err)
+		fmt.Printf("Error uploading modified HTML file to artifact store: %+v\n", uploadErr)
+		return events.APIGatewayProxyResponse{
+				Body:       fmt.Sprintf("Error uploading badge.html: %+v\n", uploadErr),
+				StatusCode: 500,
+			},
+			nil
+	}
+
+	// Hand HCTI a short-lived presigned URL to the uploaded HTML, unless the legacy public bucket access is configured
+	htmlURL, urlErr := badgeHTMLURL(store, run.key(ARTIFACT_BADGE_HTML))
+	if urlErr != nil {
 		return events.APIGatewayProxyResponse{
-				Body:       fmt.Sprintf("Error uploading badge.html to S3: %+v\n", uploadErr),
+				Body:       fmt.Sprintf("Error creating badge.html URL: %+v\n", urlErr),
 				StatusCode: 500,
 			},
 			nil
 	}
 
 	// Call the HCTI Image processing API to convert the modified and published HTML document to a cropped badge img
-	resizedImageURL, resizeErr := resizePostedBadge()
+	resizedImageURL, resizeErr := resizePostedBadge(htmlURL)
 	if resizeErr != nil {
 		fmt.Printf("Error calling HCTI API to convert HTML to image: %+v\n", resizeErr)
 		return events.APIGatewayProxyResponse{
@@ -134,10 +194,10 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 			nil
 	}
 
-	// Download the extracted badge from the URL that HCTI is hosting it at, and upload it to the S3 bucket
-	copyErr := copyExtractedBadgeImageToS3(resizedImageURL)
+	// Download the extracted badge from the URL that HCTI is hosting it at, and upload it to the artifact store
+	copyErr := copyExtractedBadgeImage(store, run, resizedImageURL, provenance)
 	if copyErr != nil {
-		fmt.Printf("Error copying extracted badge image from HCTI to S3 bucket: %+v\n", copyErr)
+		fmt.Printf("Error copying extracted badge image from HCTI to artifact store: %+v\n", copyErr)
 		return events.APIGatewayProxyResponse{
 				Body:       fmt.Sprintf("Error copying image from HCTI: %+v\n", copyErr),
 				StatusCode: 500,
@@ -145,26 +205,113 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 			nil
 	}
 
-	// Clone my special Github profile repository and overwrite the badge image it contains with the newly updated
-	// badge image that was returned by the HCTI API and written locally to the lambda execution context
-	updateErr := updateBadgeImage()
-	if updateErr != nil {
-		fmt.Printf("Error updating wren badge via git: %+v\n", updateErr)
+	// Clone my special Github profile repository, and any other target repository, and overwrite the badge image it contains with
+	// the newly updated badge image that was returned by the HCTI API and written locally to the lambda execution context
+	delivery, delivered := summarizeDeliveries(deliverBadge(store, run, targets))
+
+	// Add this run to the manifest of every run, and point latest/ at its artifacts if the badge was delivered. This happens once
+	// delivery has finished, so that the visual diffs archived while delivering are recorded along with the badge
+	publishErr := publishRun(store, run, delivered)
+	if publishErr != nil {
+		fmt.Printf("Error publishing run to the archive: %+v\n", publishErr)
+		return events.APIGatewayProxyResponse{
+				Body:       fmt.Sprintf("Error publishing run: %+v\n", publishErr),
+				StatusCode: 500,
+			},
+			nil
+	}
+
+	// Refresh the browsable gallery of every archived badge. This is a convenience, so a failure doesn't stop the badge update
+	galleryErr := publishGallery(store)
+	if galleryErr != nil {
+		fmt.Printf("Error publishing badge gallery: %+v\n", galleryErr)
+	}
+
+	if !delivered {
+		fmt.Printf("Error updating wren badge via git: %s\n", delivery)
 		return events.APIGatewayProxyResponse{
-				Body:       fmt.Sprintf("Error updating wren badge: %+v\n", updateErr),
+				Body:       fmt.Sprintf("Error updating wren badge: %s\n", delivery),
 				StatusCode: 500,
 			},
 			nil
 	}
 
+	fmt.Printf("Delivered badge %s\n", delivery)
+
+	// Optionally clean up archived artifacts that have outlived the retention policy. A failure here doesn't fail the run,
+	// since the badge has already been delivered
+	if getEnvBool("PRUNE_AFTER_RUN") {
+		policy, policyErr := getRetentionPolicy()
+		if policyErr == nil {
+			policyErr = pruneArtifacts(store, policy, getEnvBool("PRUNE_DRY_RUN"))
+		}
+		if policyErr != nil {
+			fmt.Printf("Error pruning expired artifacts: %+v\n", policyErr)
+		}
+	}
+
 	// At this point, all processing steps have completed successfully, without error, so return a success response
 	return events.APIGatewayProxyResponse{
-			Body:       "Finished processing without error",
+			Body:       fmt.Sprintf("Finished processing without error, delivered badge %s", delivery),
 			StatusCode: 200,
 		},
 		nil
 }
 
 func main() {
+	// When invoked with a command, run it locally instead of starting the Lambda handler
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	lambda.Start(handler)
 }
+
+// runCommand runs one of the local commands and returns the process exit code
+func runCommand(args []string) int {
+	switch args[0] {
+	case "run":
+		// Run the whole pipeline once from the command line, printing the response the Lambda function would have returned
+		response, err := handler(events.APIGatewayProxyRequest{})
+		if err != nil {
+			fmt.Printf("Error running badge rotator: %+v\n", err)
+			return 1
+		}
+		fmt.Printf("%d: %s\n", response.StatusCode, response.Body)
+		if response.StatusCode != 200 {
+			return 1
+		}
+		return 0
+	case "prune":
+		// Delete archived artifacts that have outlived the retention policy, or just list them with --dry-run
+		dryRun := len(args) > 1 && args[1] == "--dry-run"
+		store, err := newArtifactStore()
+		if err != nil {
+			fmt.Printf("Error creating artifact store: %+v\n", err)
+			return 1
+		}
+		policy, err := getRetentionPolicy()
+		if err != nil {
+			fmt.Printf("Error reading retention policy: %+v\n", err)
+			return 1
+		}
+		if err := pruneArtifacts(store, policy, dryRun); err != nil {
+			fmt.Printf("Error pruning artifacts: %+v\n", err)
+			return 1
+		}
+		return 0
+	case "inspect":
+		if len(args) != 2 {
+			fmt.Println("Usage: wren-badge-rotator inspect <badge.png>")
+			return 2
+		}
+		if err := inspectBadge(args[1]); err != nil {
+			fmt.Printf("Error inspecting badge: %+v\n", err)
+			return 1
+		}
+		return 0
+	default:
+		fmt.Printf("Unknown command: %s\n", args[0])
+		return 2
+	}
+}
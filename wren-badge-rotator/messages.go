@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	// Embed the timezone database, so BADGE_TIMEZONE works in Lambda runtimes that don't ship one
+	_ "time/tzdata"
+)
+
+const (
+	// The default templates for the text of every badge update. They are rendered with MessageData, or PullRequestDetails
+	// for the Pull Request body
+	DEFAULT_BRANCH_NAME_TEMPLATE        = BADGE_BRANCH_PREFIX + "{{.User}}-{{with .Target}}{{.}}-{{end}}{{.YearMonth}}"
+	DEFAULT_COMMIT_MESSAGE_TEMPLATE     = "Update Project Wren Badge with monthly stats for {{.Month}}"
+	DEFAULT_PULL_REQUEST_TITLE_TEMPLATE = "Update Project Wren Badge for {{.Month}}"
+	// DEFAULT_LOCALE is the locale month names and dates are written in when BADGE_LOCALE is not set
+	DEFAULT_LOCALE = "en"
+	// STALE_BRANCH_MONTHS is how many months back badge branches are recognized, to close Pull Requests left open from then
+	STALE_BRANCH_MONTHS = 24
+)
+
+// Locale holds what's needed to write dates in a language
+type Locale struct {
+	// Months are the names of the months, January first
+	Months [12]string
+	// DateLayout is the time.Format layout of a full date, whose January is replaced with the month's name
+	DateLayout string
+}
+
+// locales are the languages month names and dates can be written in, keyed by their BADGE_LOCALE code
+var locales = map[string]Locale{
+	"en": {
+		Months:     [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		DateLayout: "January 2, 2006",
+	},
+	"de": {
+		Months:     [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		DateLayout: "2. January 2006",
+	},
+	"es": {
+		Months:     [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		DateLayout: "2 de January de 2006",
+	},
+	"fr": {
+		Months:     [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		DateLayout: "2 January 2006",
+	},
+	"it": {
+		Months:     [12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		DateLayout: "2 January 2006",
+	},
+	"nl": {
+		Months:     [12]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+		DateLayout: "2 January 2006",
+	},
+	"pt": {
+		Months:     [12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		DateLayout: "2 de January de 2006",
+	},
+	"sv": {
+		Months:     [12]string{"januari", "februari", "mars", "april", "maj", "juni", "juli", "augusti", "september", "oktober", "november", "december"},
+		DateLayout: "2 January 2006",
+	},
+}
+
+// MessageSettings are the timezone and locale the text of a badge update is written for
+type MessageSettings struct {
+	Location *time.Location
+	Locale   Locale
+}
+
+// getMessageSettings reads the BADGE_TIMEZONE env var, an IANA timezone such as America/New_York that decides which month a
+// run belongs to (defaults to UTC), and the BADGE_LOCALE env var, the language month names and dates are written in
+func getMessageSettings() (MessageSettings, error) {
+	location, err := time.LoadLocation(getEnvString("BADGE_TIMEZONE", "UTC"))
+	if err != nil {
+		return MessageSettings{}, fmt.Errorf("BADGE_TIMEZONE must be an IANA timezone such as America/New_York: %v", err)
+	}
+
+	code := strings.ToLower(getEnvString("BADGE_LOCALE", DEFAULT_LOCALE))
+	// Accept full locale names such as de_DE or pt-BR
+	code = strings.SplitN(strings.SplitN(code, "_", 2)[0], "-", 2)[0]
+
+	locale, ok := locales[code]
+	if !ok {
+		supported := []string{}
+		for name := range locales {
+			supported = append(supported, name)
+		}
+		sort.Strings(supported)
+		return MessageSettings{}, fmt.Errorf("BADGE_LOCALE %s is not supported, use one of %s", os.Getenv("BADGE_LOCALE"), strings.Join(supported, ", "))
+	}
+
+	return MessageSettings{Location: location, Locale: locale}, nil
+}
+
+// monthName returns the name of t's month in the locale, in the configured timezone
+func (s MessageSettings) monthName(t time.Time) string {
+	return s.Locale.Months[t.In(s.Location).Month()-1]
+}
+
+// formatDate writes t as a full date in the locale, in the configured timezone
+func (s MessageSettings) formatDate(t time.Time) string {
+	local := t.In(s.Location)
+	return strings.Replace(local.Format(s.Locale.DateLayout), local.Month().String(), s.monthName(t), 1)
+}
+
+// funcs are the functions available to every template: month and date localize a time, and formatTime formats it with a Go
+// layout in the configured timezone
+func (s MessageSettings) funcs() template.FuncMap {
+	return template.FuncMap{
+		"month": s.monthName,
+		"date":  s.formatDate,
+		"formatTime": func(layout string, t time.Time) string {
+			return t.In(s.Location).Format(layout)
+		},
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+		"cell":  markdownCell,
+	}
+}
+
+// MessageData is what the branch name, commit message and Pull Request title templates can refer to
+type MessageData struct {
+	// User is the Wren username, and RunID the ID of the run that produced the badge
+	User  string
+	RunID string
+	// Target is the name of the target the badge is being delivered to, which is empty when it is only delivered to REPO_URL
+	Target string
+	// Stats are the new badge's stats
+	Stats BadgeStats
+	// Date is when the run started, in the configured timezone
+	Date time.Time
+	// Month is the localized name of Date's month, Year its four digit year, and YearMonth the year and month as 2006-01
+	Month     string
+	Year      string
+	YearMonth string
+}
+
+// newMessageData gathers the template data describing run's delivery to target
+func newMessageData(settings MessageSettings, run *Run, target *Target) MessageData {
+	local := run.StartedAt.In(settings.Location)
+	return MessageData{
+		User:      run.User,
+		RunID:     run.ID,
+		Target:    target.Name,
+		Stats:     run.Stats,
+		Date:      local,
+		Month:     settings.monthName(local),
+		Year:      local.Format("2006"),
+		YearMonth: local.Format("2006-01"),
+	}
+}
+
+// renderMessage renders the template in the env var name, or defaultTemplate if it is unset, with data
+func renderMessage(settings MessageSettings, name, defaultTemplate string, data interface{}) (string, error) {
+	tmpl, err := template.New(name).Funcs(settings.funcs()).Option("missingkey=error").Parse(getEnvString(name, defaultTemplate))
+	if err != nil {
+		return "", fmt.Errorf("Error parsing %s: %v", name, err)
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("Error rendering %s: %v", name, err)
+	}
+
+	return out.String(), nil
+}
+
+// runMessage renders one of the templates describing run's delivery to target
+func runMessage(name, defaultTemplate string, run *Run, target *Target) (string, error) {
+	settings, err := getMessageSettings()
+	if err != nil {
+		return "", err
+	}
+
+	message, err := renderMessage(settings, name, defaultTemplate, newMessageData(settings, run, target))
+	return strings.TrimSpace(message), err
+}
+
+// badgeBranchName names the branch the badge update of target is committed to, from the BRANCH_NAME_TEMPLATE env var. By
+// default it includes the Wren user, the target's name, year and month, so that it's unique to each user's monthly update of
+// each target, even when several targets share a repository, and a rerun in the same month reuses it
+func badgeBranchName(run *Run, target *Target) (string, error) {
+	branch, err := runMessage("BRANCH_NAME_TEMPLATE", DEFAULT_BRANCH_NAME_TEMPLATE, run, target)
+	if err != nil {
+		return "", err
+	}
+
+	if branch == "" || strings.ContainsAny(branch, " ~^:?*[\\") || strings.Contains(branch, "..") || strings.HasSuffix(branch, ".lock") {
+		return "", fmt.Errorf("BRANCH_NAME_TEMPLATE rendered an invalid branch name: %q", branch)
+	}
+
+	return branch, nil
+}
+
+// earlierBadgeBranches names the branches this run's user was given for target in each of the STALE_BRANCH_MONTHS months before
+// the run, by rendering BRANCH_NAME_TEMPLATE for those months. This is how badge Pull Requests left open from earlier months
+// are recognized, without mistaking another Wren user's or another target's badge branches in the same repository for them
+func earlierBadgeBranches(run *Run, target *Target) (map[string]bool, error) {
+	settings, err := getMessageSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := badgeBranchName(run, target)
+	if err != nil {
+		return nil, err
+	}
+
+	// Step back from the middle of the run's month, so that each earlier month is landed on exactly once
+	local := run.StartedAt.In(settings.Location)
+	middle := time.Date(local.Year(), local.Month(), 15, 12, 0, 0, 0, settings.Location)
+
+	branches := map[string]bool{}
+	for i := 1; i <= STALE_BRANCH_MONTHS; i++ {
+		earlier := *run
+		earlier.StartedAt = middle.AddDate(0, -i, 0)
+
+		branch, err := badgeBranchName(&earlier, target)
+		if err != nil {
+			return nil, err
+		}
+		// A template without the month names the same branch every month, which is refreshed rather than closed
+		if branch != current {
+			branches[branch] = true
+		}
+	}
+
+	return branches, nil
+}
+
+// badgeCommitMessage describes the badge update commit, from the COMMIT_MESSAGE_TEMPLATE env var. By default it includes the
+// month for easier scanning
+func badgeCommitMessage(run *Run, target *Target) (string, error) {
+	return runMessage("COMMIT_MESSAGE_TEMPLATE", DEFAULT_COMMIT_MESSAGE_TEMPLATE, run, target)
+}
+
+// pullRequestTitle titles the badge Pull Request, from the PULL_REQUEST_TITLE_TEMPLATE env var
+func pullRequestTitle(run *Run, target *Target) (string, error) {
+	return runMessage("PULL_REQUEST_TITLE_TEMPLATE", DEFAULT_PULL_REQUEST_TITLE_TEMPLATE, run, target)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// pngSignature is the 8 byte header every PNG file starts with
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+const (
+	// RENDERER_NAME identifies the service that converts the badge HTML to an image
+	RENDERER_NAME = "hcti"
+	// The PNG text keywords that provenance metadata is written under. Creation Time, Source and Software are keywords
+	// registered by the PNG specification, the rest are specific to this tool
+	PNG_KEY_CREATION_TIME = "Creation Time"
+	PNG_KEY_SOURCE        = "Source"
+	PNG_KEY_SOFTWARE      = "Software"
+	PNG_KEY_RUN_ID        = "wren:run-id"
+	PNG_KEY_STATS         = "wren:stats"
+	PNG_KEY_THEME         = "wren:theme"
+	PNG_KEY_RENDERER      = "wren:renderer"
+	PNG_KEY_VERSION       = "wren:version"
+)
+
+// BadgeProvenance records where a badge image came from, so that anyone looking at the badge file in a repository can tell
+// when, from what, and by which version of this tool it was produced
+type BadgeProvenance struct {
+	SourceURL string
+	ScrapedAt time.Time
+	RunID     string
+	Stats     BadgeStats
+	Theme     string
+	Renderer  string
+	Version   string
+}
+
+// textChunks converts the provenance into the keyword / value pairs that are written to the PNG
+func (p BadgeProvenance) textChunks() (map[string]string, error) {
+	stats, err := json.Marshal(p.Stats)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		PNG_KEY_SOURCE:        p.SourceURL,
+		PNG_KEY_CREATION_TIME: p.ScrapedAt.UTC().Format(time.RFC3339),
+		PNG_KEY_SOFTWARE:      fmt.Sprintf("wren-badge-rotator %s", p.Version),
+		PNG_KEY_RUN_ID:        p.RunID,
+		PNG_KEY_STATS:         string(stats),
+		PNG_KEY_THEME:         p.Theme,
+		PNG_KEY_RENDERER:      p.Renderer,
+		PNG_KEY_VERSION:       p.Version,
+	}, nil
+}
+
+// embedProvenance rewrites the PNG at imagePath with the provenance written into text chunks directly after the IHDR chunk.
+// Values that are plain ASCII are stored as tEXt chunks, anything else (such as scraped stats) as UTF-8 iTXt chunks
+func embedProvenance(imagePath string, provenance BadgeProvenance) error {
+	contents, err := ioutil.ReadFile(imagePath)
+	if err != nil {
+		return err
+	}
+
+	chunks, err := provenance.textChunks()
+	if err != nil {
+		return err
+	}
+
+	if !bytes.HasPrefix(contents, pngSignature) {
+		return errors.New("Badge image is not a PNG file")
+	}
+
+	// The IHDR chunk is always first: 4 bytes of length, 4 bytes of type, 13 bytes of data and a 4 byte CRC
+	ihdrEnd := len(pngSignature) + 4 + 4 + 13 + 4
+	if len(contents) < ihdrEnd {
+		return errors.New("Badge image is truncated")
+	}
+
+	var out bytes.Buffer
+	out.Write(contents[:ihdrEnd])
+
+	// Write the keywords in a stable order so the same provenance always produces the same bytes
+	keys := make([]string, 0, len(chunks))
+	for key := range chunks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if isASCII(chunks[key]) {
+			writePNGChunk(&out, "tEXt", []byte(key+"\x00"+chunks[key]))
+			continue
+		}
+		// iTXt: keyword, null separator, compression flag, compression method, empty language tag and translated keyword
+		writePNGChunk(&out, "iTXt", []byte(key+"\x00\x00\x00\x00\x00"+chunks[key]))
+	}
+
+	out.Write(contents[ihdrEnd:])
+
+	return ioutil.WriteFile(imagePath, out.Bytes(), 0644)
+}
+
+// readPNGText returns every tEXt, zTXt and iTXt keyword / value pair stored in the PNG at imagePath
+func readPNGText(imagePath string) (map[string]string, error) {
+	contents, err := ioutil.ReadFile(imagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(contents, pngSignature) {
+		return nil, fmt.Errorf("%s is not a PNG file", imagePath)
+	}
+
+	text := map[string]string{}
+	offset := len(pngSignature)
+
+	for offset+8 <= len(contents) {
+		length := int(binary.BigEndian.Uint32(contents[offset : offset+4]))
+		chunkType := string(contents[offset+4 : offset+8])
+		dataStart := offset + 8
+		dataEnd := dataStart + length
+
+		if dataEnd+4 > len(contents) {
+			return nil, fmt.Errorf("%s contains a truncated %s chunk", imagePath, chunkType)
+		}
+
+		data := contents[dataStart:dataEnd]
+
+		switch chunkType {
+		case "tEXt":
+			parts := bytes.SplitN(data, []byte{0}, 2)
+			if len(parts) == 2 {
+				text[string(parts[0])] = string(parts[1])
+			}
+		case "zTXt":
+			parts := bytes.SplitN(data, []byte{0}, 2)
+			if len(parts) == 2 && len(parts[1]) > 0 {
+				value, inflateErr := inflate(parts[1][1:])
+				if inflateErr != nil {
+					return nil, inflateErr
+				}
+				text[string(parts[0])] = string(value)
+			}
+		case "iTXt":
+			key, value, parseErr := parseITXt(data)
+			if parseErr != nil {
+				return nil, parseErr
+			}
+			text[key] = value
+		case "IEND":
+			return text, nil
+		}
+
+		offset = dataEnd + 4
+	}
+
+	return text, nil
+}
+
+// stripPNGText returns the PNG in contents without its tEXt, zTXt and iTXt chunks, or false if contents isn't a well-formed PNG
+func stripPNGText(contents []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(contents, pngSignature) {
+		return nil, false
+	}
+
+	var out bytes.Buffer
+	out.Write(pngSignature)
+	offset := len(pngSignature)
+
+	for offset+8 <= len(contents) {
+		length := int(binary.BigEndian.Uint32(contents[offset : offset+4]))
+		chunkEnd := offset + 8 + length + 4
+		if length < 0 || chunkEnd > len(contents) {
+			return nil, false
+		}
+
+		switch string(contents[offset+4 : offset+8]) {
+		case "tEXt", "zTXt", "iTXt":
+		default:
+			out.Write(contents[offset:chunkEnd])
+		}
+
+		offset = chunkEnd
+	}
+
+	return out.Bytes(), offset == len(contents)
+}
+
+// samePNGImage reports whether a and b are PNGs that only differ in their text metadata, such as the provenance of badges
+// rendered by different runs from the same stats
+func samePNGImage(a, b []byte) bool {
+	strippedA, okA := stripPNGText(a)
+	strippedB, okB := stripPNGText(b)
+	return okA && okB && bytes.Equal(strippedA, strippedB)
+}
+
+// parseITXt decodes the keyword and text of an iTXt chunk, inflating the text if the chunk is compressed
+func parseITXt(data []byte) (string, string, error) {
+	parts := bytes.SplitN(data, []byte{0}, 2)
+	if len(parts) != 2 || len(parts[1]) < 2 {
+		return "", "", errors.New("Malformed iTXt chunk")
+	}
+
+	key := string(parts[0])
+	compressed := parts[1][0] == 1
+
+	// Skip past the compression flag and method, then the language tag and translated keyword
+	rest := bytes.SplitN(parts[1][2:], []byte{0}, 3)
+	if len(rest) != 3 {
+		return "", "", errors.New("Malformed iTXt chunk")
+	}
+
+	if !compressed {
+		return key, string(rest[2]), nil
+	}
+
+	value, err := inflate(rest[2])
+	if err != nil {
+		return "", "", err
+	}
+	return key, string(value), nil
+}
+
+// writePNGChunk appends a chunk of the given type, with its length prefix and CRC, to out
+func writePNGChunk(out *bytes.Buffer, chunkType string, data []byte) {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+	out.Write(length[:])
+
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(data)
+
+	out.WriteString(chunkType)
+	out.Write(data)
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	out.Write(sum[:])
+}
+
+// inflate decompresses zlib compressed chunk data
+func inflate(data []byte) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// isASCII reports whether s can be stored in a tEXt chunk without loss
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// inspectBadge prints the provenance metadata stored in the badge image at imagePath
+func inspectBadge(imagePath string) error {
+	text, err := readPNGText(imagePath)
+	if err != nil {
+		return err
+	}
+
+	if len(text) == 0 {
+		fmt.Printf("%s contains no text metadata\n", imagePath)
+		return nil
+	}
+
+	keys := make([]string, 0, len(text))
+	for key := range text {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Printf("%s: %s\n", key, text[key])
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// renderedBadge returns the test badge as a run would publish it, with the run's provenance embedded
+func renderedBadge(t *testing.T, width int, runID string, scrapedAt time.Time) []byte {
+	badgePath := writeTestBadge(t, width, defaultTheme.Height, 0)
+
+	err := embedProvenance(badgePath, BadgeProvenance{
+		SourceURL: WrenBadgeURL,
+		ScrapedAt: scrapedAt,
+		RunID:     runID,
+		Stats:     BadgeStats{Headline: "Zack", Tons: "12 tons"},
+		Theme:     defaultTheme.Name,
+		Renderer:  RENDERER_NAME,
+		Version:   VERSION,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(badgePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+func TestFileStatusIgnoresProvenance(t *testing.T) {
+	previous := renderedBadge(t, defaultTheme.Width, "20261001T080000Z-aaaa", time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC))
+	rerun := renderedBadge(t, defaultTheme.Width, "20261002T080000Z-bbbb", time.Date(2026, 10, 2, 8, 0, 0, 0, time.UTC))
+	changed := renderedBadge(t, defaultTheme.Width+1, "20261002T080000Z-bbbb", time.Date(2026, 10, 2, 8, 0, 0, 0, time.UTC))
+
+	if status := fileStatus(rerun, previous, true); status != FILE_UNCHANGED {
+		t.Errorf("A badge only differing in its provenance is %s, want %s", status, FILE_UNCHANGED)
+	}
+	if status := fileStatus(changed, previous, true); status != FILE_MODIFIED {
+		t.Errorf("A badge with different pixels is %s, want %s", status, FILE_MODIFIED)
+	}
+	if status := fileStatus([]byte("not a png"), []byte("not a png either"), true); status != FILE_MODIFIED {
+		t.Errorf("Different text files are %s, want %s", status, FILE_MODIFIED)
+	}
+
+	// The provenance itself is still there to inspect
+	badgePath := filepath.Join(t.TempDir(), "badge.png")
+	if err := ioutil.WriteFile(badgePath, rerun, 0644); err != nil {
+		t.Fatal(err)
+	}
+	text, err := readPNGText(badgePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text[PNG_KEY_RUN_ID] != "20261002T080000Z-bbbb" {
+		t.Errorf("The embedded run ID is %q", text[PNG_KEY_RUN_ID])
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PULL_REQUEST_LINK_TTL is how long the presigned links to a private bucket's archived images stay valid. This is the longest
+// S3 allows, though links signed with temporary credentials, such as the Lambda function's role, expire with them, usually
+// within hours
+const PULL_REQUEST_LINK_TTL = 7 * 24 * time.Hour
+
+// DEFAULT_PULL_REQUEST_BODY_TEMPLATE is the markdown body of every badge Pull Request, rendered with PullRequestDetails. It is
+// replaced by the PULL_REQUEST_BODY_TEMPLATE env var
+const DEFAULT_PULL_REQUEST_BODY_TEMPLATE = `Swap in the latest badge with the stats for {{.Month}}.
+
+| Stat | Previous | New | Change |
+| --- | --- | --- | --- |
+{{range .Stats}}| {{cell .Name}} | {{cell .Previous}} | {{cell .Current}} | {{cell .Change}} |
+{{end}}
+{{if .BeforeURL}}[Before]({{.BeforeURL}}) · {{end}}[After]({{.AfterURL}}){{if .DiffURL}} · [Difference]({{.DiffURL}}){{end}}
+{{- if not .LinksExpire.IsZero}}
+
+_These links expire on {{date .LinksExpire}} at {{formatTime "15:04 MST" .LinksExpire}}._
+{{- end}}
+
+<details>
+<summary>Run details</summary>
+
+* Run: ` + "`{{.Run.ID}}`" + `
+{{- if .Previous}}
+* Previous run: ` + "`{{.Previous.ID}}`" + `
+{{- end}}
+* Renderer: {{.Renderer}}
+* Theme: {{.Theme}}
+* Version: {{.Version}}
+
+</details>
+`
+
+// PullRequestDetails is everything a badge Pull Request's body describes, on top of the MessageData every template can use
+type PullRequestDetails struct {
+	MessageData
+	// Run is the run that produced the new badge, and Previous the archived run that produced the badge it replaces, if any
+	Run      *Run
+	Previous *Run
+	// Stats compares each of the badge's stats with the previous badge's
+	Stats []StatChange
+	// BeforeURL, AfterURL and DiffURL link to the archived previous badge, new badge and highlighted difference between them.
+	// BeforeURL and DiffURL are empty when there is no previous badge
+	BeforeURL string
+	AfterURL  string
+	DiffURL   string
+	// LinksExpire is when presigned links stop working, which is when the credentials that signed them expire if that is sooner
+	// than PULL_REQUEST_LINK_TTL, and zero when the links are permanent
+	LinksExpire time.Time
+	// Renderer, Theme and Version describe how the badge was produced
+	Renderer string
+	Theme    string
+	Version  string
+}
+
+// StatChange is a row of the stats table
+type StatChange struct {
+	Name     string
+	Previous string
+	Current  string
+	Change   string
+}
+
+// compareStats lists each stat of the new badge alongside its previous value and how it changed. previous is nil on the first run
+func compareStats(previous *BadgeStats, current BadgeStats) []StatChange {
+	textChange := func(before, after string) string {
+		switch {
+		case previous == nil:
+			return "new"
+		case before == after:
+			return "unchanged"
+		default:
+			return "changed"
+		}
+	}
+
+	rows := []StatChange{
+		{Name: "Headline", Current: current.Headline},
+		{Name: "Tons", Current: current.Tons},
+		{Name: "Tons offset", Current: formatTons(current.TonsOffset)},
+	}
+
+	if previous != nil {
+		rows[0].Previous = previous.Headline
+		rows[1].Previous = previous.Tons
+		rows[2].Previous = formatTons(previous.TonsOffset)
+	}
+
+	rows[0].Change = textChange(rows[0].Previous, rows[0].Current)
+	rows[1].Change = textChange(rows[1].Previous, rows[1].Current)
+
+	switch {
+	case previous == nil:
+		rows[2].Change = "new"
+	case current.TonsOffset == previous.TonsOffset:
+		rows[2].Change = "unchanged"
+	default:
+		rows[2].Change = fmt.Sprintf("%+g", current.TonsOffset-previous.TonsOffset)
+	}
+
+	return rows
+}
+
+// formatTons formats a tons figure without trailing zeros
+func formatTons(tons float64) string {
+	return strconv.FormatFloat(tons, 'f', -1, 64)
+}
+
+// markdownCell escapes a value for a markdown table cell, where pipes and newlines would break the table
+func markdownCell(value string) string {
+	if value == "" {
+		return "-"
+	}
+	value = strings.Replace(value, "|", `\|`, -1)
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// findPreviousRun returns the most recent delivered run for the same Wren user before run whose badge is still archived, which
+// produced the badge being replaced, or nil if there is none. A run whose delivery failed never replaced anything. Retention
+// deletes the badges of every run but the final one of each month, while the manifest keeps listing runs with other artifacts
+// left, so the badge is looked for in the store itself
+func findPreviousRun(store ArtifactStore, run *Run) (*Run, error) {
+	manifest, err := loadManifest(store)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(manifest.Runs) - 1; i >= 0; i-- {
+		candidate := manifest.Runs[i]
+		if candidate.ID == run.ID || candidate.User != run.User || candidate.ID > run.ID || !candidate.delivered() {
+			continue
+		}
+		if _, ok := candidate.Artifacts[ARTIFACT_BADGE_PNG]; !ok {
+			continue
+		}
+
+		badgeKey := candidate.key(ARTIFACT_BADGE_PNG)
+		keys, err := store.List(badgeKey)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if key == badgeKey {
+				return &candidate, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// artifactLinkURL returns a link to an archived artifact that can be followed from a Pull Request. Publicly served artifacts
+// are linked to directly, and those in a private S3 bucket with presigned URLs, whose actual expiry is returned alongside them
+func artifactLinkURL(store ArtifactStore, key string) (string, time.Time, error) {
+	presigner, ok := store.(PresignedURLStore)
+	if !ok || artifactsServedPublicly(store) {
+		return store.URL(key), time.Time{}, nil
+	}
+
+	return presigner.PresignedURL(key, PULL_REQUEST_LINK_TTL)
+}
+
+// pullRequestDetails gathers the details of the run's badge update of the target for its Pull Request
+func pullRequestDetails(settings MessageSettings, store ArtifactStore, run *Run, target *Target) (PullRequestDetails, error) {
+	details := PullRequestDetails{
+		MessageData: newMessageData(settings, run, target),
+		Run:         run,
+		Renderer:    RENDERER_NAME,
+		Theme:       defaultTheme.Name,
+		Version:     VERSION,
+	}
+
+	previous, err := findPreviousRun(store, run)
+	if err != nil {
+		return details, err
+	}
+
+	details.Previous = previous
+
+	var previousStats *BadgeStats
+	if previous != nil {
+		previousStats = &previous.Stats
+	}
+	details.Stats = compareStats(previousStats, run.Stats)
+
+	details.AfterURL, details.LinksExpire, err = artifactLinkURL(store, run.key(ARTIFACT_BADGE_PNG))
+	if err != nil {
+		return details, err
+	}
+
+	if previous != nil {
+		details.BeforeURL, _, err = artifactLinkURL(store, previous.key(ARTIFACT_BADGE_PNG))
+		if err != nil {
+			return details, err
+		}
+	}
+
+	// The difference is from the badge currently in the target repository
+	if diffArtifact := target.fileName(ARTIFACT_BADGE_DIFF); run.hasArtifact(diffArtifact) {
+		details.DiffURL, _, err = artifactLinkURL(store, run.key(diffArtifact))
+		if err != nil {
+			return details, err
+		}
+	}
+
+	return details, nil
+}
+
+// pullRequestBody describes the run's badge update of the target in markdown, for the body of its Pull Request
+func pullRequestBody(store ArtifactStore, run *Run, target *Target) (string, error) {
+	settings, err := getMessageSettings()
+	if err != nil {
+		return "", err
+	}
+
+	details, err := pullRequestDetails(settings, store, run, target)
+	if err != nil {
+		return "", err
+	}
+
+	return renderMessage(settings, "PULL_REQUEST_BODY_TEMPLATE", DEFAULT_PULL_REQUEST_BODY_TEMPLATE, details)
+}
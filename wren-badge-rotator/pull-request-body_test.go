@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindPreviousRun(t *testing.T) {
+	store := newMemoryArtifactStore()
+
+	publish := func(day int, user string, delivered bool) *Run {
+		run, err := newRun(time.Date(2026, 10, day, 8, 0, 0, 0, time.UTC), user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := run.archiveArtifact(store, ARTIFACT_BADGE_PNG, strings.NewReader("badge")); err != nil {
+			t.Fatal(err)
+		}
+		if err := run.archiveArtifact(store, ARTIFACT_SOURCE_HTML, strings.NewReader("source")); err != nil {
+			t.Fatal(err)
+		}
+		if err := publishRun(store, run, delivered); err != nil {
+			t.Fatal(err)
+		}
+		return run
+	}
+
+	first := publish(1, "zackproser", true)
+	second := publish(2, "zackproser", true)
+	publish(3, "someone-else", true)
+	// A run whose badge wasn't delivered, such as one the visual diff gate blocked, didn't replace the second run's badge
+	publish(3, "zackproser", false)
+	current, err := newRun(time.Date(2026, 10, 4, 8, 0, 0, 0, time.UTC), "zackproser")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if previous, err := findPreviousRun(store, current); err != nil || previous == nil || previous.ID != second.ID {
+		t.Errorf("findPreviousRun() = %+v, %v, want run %s", previous, err, second.ID)
+	}
+
+	// Retention deletes the badge of a run that wasn't the last of its month, leaving the run in the manifest
+	if err := store.Delete(second.key(ARTIFACT_BADGE_PNG)); err != nil {
+		t.Fatal(err)
+	}
+	if previous, err := findPreviousRun(store, current); err != nil || previous == nil || previous.ID != first.ID {
+		t.Errorf("With the latest badge pruned, findPreviousRun() = %+v, %v, want run %s", previous, err, first.ID)
+	}
+
+	if err := store.Delete(first.key(ARTIFACT_BADGE_PNG)); err != nil {
+		t.Fatal(err)
+	}
+	if previous, err := findPreviousRun(store, current); err != nil || previous != nil {
+		t.Errorf("With every badge pruned, findPreviousRun() = %+v, %v, want none", previous, err)
+	}
+}
+
+// presigningStore is an in-memory store that presigns URLs the way a private bucket does, with signing credentials that expire
+// at credentialsExpire
+type presigningStore struct {
+	*MemoryArtifactStore
+	credentialsExpire time.Time
+}
+
+func (s *presigningStore) PresignedURL(key string, ttl time.Duration) (string, time.Time, error) {
+	expires := time.Now().Add(ttl)
+	if s.credentialsExpire.Before(expires) {
+		expires = s.credentialsExpire
+	}
+	return "https://signed.example.com/" + key, expires, nil
+}
+
+func TestPullRequestBodyLinkExpiry(t *testing.T) {
+	os.Setenv("BADGE_HTML_ACCESS", "presigned")
+	os.Setenv("S3_PUBLIC_BASE_URL", "")
+	defer os.Unsetenv("BADGE_HTML_ACCESS")
+	defer os.Unsetenv("S3_PUBLIC_BASE_URL")
+
+	credentialsExpire := time.Date(2026, 10, 4, 14, 30, 0, 0, time.UTC)
+	store := &presigningStore{MemoryArtifactStore: newMemoryArtifactStore(), credentialsExpire: credentialsExpire}
+
+	run, err := newRun(time.Date(2026, 10, 4, 8, 0, 0, 0, time.UTC), "zackproser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run.archiveArtifact(store, ARTIFACT_BADGE_PNG, strings.NewReader("badge")); err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := pullRequestBody(store, run, &Target{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The links expire with the temporary credentials that signed them, long before PULL_REQUEST_LINK_TTL
+	if !strings.Contains(body, "_These links expire on ") || !strings.Contains(body, "at 14:30 UTC._") {
+		t.Errorf("The body doesn't give the credentials' expiry as when the links expire:\n%s", body)
+	}
+
+	// Publicly served artifacts are linked to directly, and never expire
+	os.Setenv("S3_PUBLIC_BASE_URL", "https://badges.example.com")
+	body, err = pullRequestBody(store, run, &Target{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(body, "expire") {
+		t.Errorf("The body says publicly served links expire:\n%s", body)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// findBadgePullRequests lists the open change requests this tool has opened against the base branch for the run's user and
+// target, returning the one for branch separately from stale ones left open from earlier months. Only change requests whose branch
+// lives in fork, or in the repository itself when fork is nil, are considered, since that is where this tool pushes
+func findBadgePullRequests(forge Forge, run *Run, target *Target, fork *Fork, branch string) (*ChangeRequest, []*ChangeRequest, error) {
+	var current *ChangeRequest
+	var stale []*ChangeRequest
+
+	earlier, err := earlierBadgeBranches(run, target)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	crs, err := forge.ListChangeRequests()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, cr := range crs {
+		switch {
+		case !headInFork(cr, fork):
+			continue
+		case cr.HeadBranch == branch:
+			current = cr
+		case earlier[cr.HeadBranch]:
+			stale = append(stale, cr)
+		}
+	}
+
+	return current, stale, nil
+}
+
+// headInFork reports whether the change request's head branch lives in fork, or in the repository itself when fork is nil,
+// which is where this tool pushes its badge branches
+func headInFork(cr *ChangeRequest, fork *Fork) bool {
+	if fork == nil {
+		return cr.SameRepo
+	}
+	return !cr.SameRepo && strings.EqualFold(cr.HeadRepo, fork.ID)
+}
+
+// openOrUpdatePullRequest opens a Pull Request, or a Merge Request on GitLab, of the branch containing the badge changes
+// against the base branch. The branch lives in fork, or in the repository itself when fork is nil. When a previous run this
+// month already opened one for the same branch, that Pull Request is refreshed instead, since the branch itself was
+// force-updated. Badge Pull Requests still open from earlier months are closed as superseded.
+// The body compares the new badge's stats with the previous badge's, and links to both archived images
+func openOrUpdatePullRequest(forge Forge, store ArtifactStore, run *Run, target *Target, fork *Fork, branch string) (*ChangeRequest, error) {
+	pullRequestTitle, titleErr := pullRequestTitle(run, target)
+	if titleErr != nil {
+		return nil, titleErr
+	}
+
+	pullRequestDescription, bodyErr := pullRequestBody(store, run, target)
+	if bodyErr != nil {
+		return nil, bodyErr
+	}
+
+	current, stale, findErr := findBadgePullRequests(forge, run, target, fork, branch)
+	if findErr != nil {
+		return nil, findErr
+	}
+
+	var cr *ChangeRequest
+	var err error
+
+	if current != nil {
+		cr, err = forge.UpdateChangeRequest(current, pullRequestTitle,
+			fmt.Sprintf("%s\nRefreshed at %s", pullRequestDescription, refreshedAt()))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Successfully refreshed %s: %s\n", cr.Kind, cr.URL)
+	} else {
+		cr, err = forge.OpenChangeRequest(fork, branch, pullRequestTitle, pullRequestDescription)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Successfully opened %s: %s\n", cr.Kind, cr.URL)
+	}
+
+	for _, old := range stale {
+		closeErr := closeSupersededPullRequest(forge, fork, old, cr)
+		if closeErr != nil {
+			// A stale Pull Request that can't be closed shouldn't fail the badge update itself
+			fmt.Printf("Error closing superseded %s %s: %+v\n", old.Kind, old.URL, closeErr)
+		}
+	}
+
+	return cr, nil
+}
+
+// closeSupersededPullRequest comments on an old badge Pull Request to point at its replacement, closes it, and deletes its
+// branch, which findBadgePullRequests has made sure lives where this tool pushes badge branches
+func closeSupersededPullRequest(forge Forge, fork *Fork, old, replacement *ChangeRequest) error {
+	err := forge.Comment(old, fmt.Sprintf("Superseded by %s, which contains a newer badge.", replacement.Reference))
+	if err != nil {
+		return err
+	}
+
+	if err := forge.Close(old); err != nil {
+		return err
+	}
+
+	fmt.Printf("Closed superseded %s: %s\n", old.Kind, old.URL)
+
+	return forge.DeleteBranch(fork, old.HeadBranch)
+}
+
+// applyPullRequestMetadata adds the labels and assignees listed in PULL_REQUEST_LABELS and PULL_REQUEST_ASSIGNEES to the
+// Pull Request, and requests review from the target's reviewers, when they are set
+func applyPullRequestMetadata(forge Forge, cr *ChangeRequest, reviewers []string) error {
+	if labels := getEnvList("PULL_REQUEST_LABELS"); len(labels) > 0 {
+		if err := forge.AddLabels(cr, labels); err != nil {
+			return fmt.Errorf("Error labelling %s: %v", cr.URL, err)
+		}
+		fmt.Printf("Labelled %s with %s\n", cr.URL, strings.Join(labels, ", "))
+	}
+
+	if assignees := getEnvList("PULL_REQUEST_ASSIGNEES"); len(assignees) > 0 {
+		if err := forge.AddAssignees(cr, assignees); err != nil {
+			return fmt.Errorf("Error assigning %s: %v", cr.URL, err)
+		}
+		fmt.Printf("Assigned %s to %s\n", cr.URL, strings.Join(assignees, ", "))
+	}
+
+	if len(reviewers) > 0 {
+		return requestReviewers(forge, cr, reviewers)
+	}
+
+	return nil
+}
+
+// refreshedAt is the time a Pull Request is refreshed, in the configured timezone
+func refreshedAt() string {
+	settings, err := getMessageSettings()
+	if err != nil {
+		return time.Now().UTC().Format(time.RFC1123)
+	}
+	return time.Now().In(settings.Location).Format(time.RFC1123)
+}
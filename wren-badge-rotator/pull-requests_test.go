@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// listingForge is a Forge that only lists the change requests it is given
+type listingForge struct {
+	Forge
+	crs []*ChangeRequest
+}
+
+func (f *listingForge) ListChangeRequests() ([]*ChangeRequest, error) {
+	return f.crs, nil
+}
+
+func TestFindBadgePullRequests(t *testing.T) {
+	os.Unsetenv("BRANCH_NAME_TEMPLATE")
+	os.Unsetenv("BADGE_TIMEZONE")
+
+	run := &Run{ID: "run", User: "zackproser", StartedAt: time.Date(2026, 3, 31, 23, 0, 0, 0, time.UTC)}
+	fork := &Fork{ID: "bot/profile", Owner: "bot"}
+
+	own := func(branch string) *ChangeRequest {
+		return &ChangeRequest{HeadBranch: branch, SameRepo: true}
+	}
+	inFork := func(repo, branch string) *ChangeRequest {
+		return &ChangeRequest{HeadBranch: branch, HeadRepo: repo}
+	}
+
+	tests := []struct {
+		name        string
+		target      *Target
+		fork        *Fork
+		crs         []*ChangeRequest
+		wantCurrent string
+		wantStale   []string
+	}{
+		{
+			name: "earlier months of the same user",
+			crs: []*ChangeRequest{
+				own("update-wren-badge-zackproser-2026-03"),
+				own("update-wren-badge-zackproser-2026-02"),
+				own("update-wren-badge-zackproser-2025-04"),
+			},
+			wantCurrent: "update-wren-badge-zackproser-2026-03",
+			wantStale:   []string{"update-wren-badge-zackproser-2026-02", "update-wren-badge-zackproser-2025-04"},
+		},
+		{
+			name: "other users and unrelated branches are left alone",
+			crs: []*ChangeRequest{
+				own("update-wren-badge-someone-else-2026-02"),
+				own("update-wren-badge-zackproser-extra"),
+				own("update-wren-badge-zackproser-2026-04"),
+				own("feature"),
+			},
+		},
+		{
+			name: "branches in other forks are left alone",
+			crs: []*ChangeRequest{
+				inFork("someone/profile", "update-wren-badge-zackproser-2026-03"),
+				inFork("someone/profile", "update-wren-badge-zackproser-2026-02"),
+			},
+		},
+		{
+			name:   "other targets in the same repository are left alone",
+			target: &Target{Name: "site"},
+			crs: []*ChangeRequest{
+				own("update-wren-badge-zackproser-site-2026-03"),
+				own("update-wren-badge-zackproser-site-2026-02"),
+				own("update-wren-badge-zackproser-wiki-2026-02"),
+				own("update-wren-badge-zackproser-2026-02"),
+			},
+			wantCurrent: "update-wren-badge-zackproser-site-2026-03",
+			wantStale:   []string{"update-wren-badge-zackproser-site-2026-02"},
+		},
+		{
+			name: "branches in the fork pushed to",
+			fork: fork,
+			crs: []*ChangeRequest{
+				own("update-wren-badge-zackproser-2026-02"),
+				inFork("bot/profile", "update-wren-badge-zackproser-2026-03"),
+				inFork("BOT/profile", "update-wren-badge-zackproser-2026-01"),
+			},
+			wantCurrent: "update-wren-badge-zackproser-2026-03",
+			wantStale:   []string{"update-wren-badge-zackproser-2026-01"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.target == nil {
+				tt.target = &Target{}
+			}
+			branch, err := badgeBranchName(run, tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			current, stale, err := findBadgePullRequests(&listingForge{crs: tt.crs}, run, tt.target, tt.fork, branch)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotCurrent := ""
+			if current != nil {
+				gotCurrent = current.HeadBranch
+			}
+			if gotCurrent != tt.wantCurrent {
+				t.Errorf("current = %q, want %q", gotCurrent, tt.wantCurrent)
+			}
+
+			gotStale := []string{}
+			for _, cr := range stale {
+				gotStale = append(gotStale, cr.HeadBranch)
+			}
+			if tt.wantStale == nil {
+				tt.wantStale = []string{}
+			}
+			if !reflect.DeepEqual(gotStale, tt.wantStale) {
+				t.Errorf("stale = %v, want %v", gotStale, tt.wantStale)
+			}
+		})
+	}
+}
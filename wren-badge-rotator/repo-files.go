@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+const (
+	// The kinds of output that can be written to the profile repository
+	OUTPUT_BADGE_PNG     = "badge-png"
+	OUTPUT_BADGE_SVG     = "badge-svg"
+	OUTPUT_STATS_JSON    = "stats-json"
+	OUTPUT_README_REGION = "readme-region"
+	// DEFAULT_BADGE_OUTPUTS is used when BADGE_OUTPUTS is not set, and only replaces the badge image
+	DEFAULT_BADGE_OUTPUTS = OUTPUT_BADGE_PNG + ":" + BADGE_REPO_PATH
+	// README_REGION_START and README_REGION_END mark the part of a markdown file that a readme-region output replaces
+	README_REGION_START = "<!-- wren-badge:start -->"
+	README_REGION_END   = "<!-- wren-badge:end -->"
+	// The statuses reported for each file written to the repository
+	FILE_ADDED     = "added"
+	FILE_MODIFIED  = "modified"
+	FILE_UNCHANGED = "unchanged"
+)
+
+// BadgeOutput declares a single file written to the profile repository on every run
+type BadgeOutput struct {
+	// Kind is one of the OUTPUT_ constants
+	Kind string
+	// Path is where the file lives in the repository
+	Path string
+	// Width resizes a badge-png output to the given width in pixels, keeping its aspect ratio. 0 keeps the original size
+	Width int
+	// ImageURL is where a readme-region output embeds the badge image from, when the image isn't on the same branch as the
+	// README. It is empty when the image is linked to by its path relative to the README
+	ImageURL string
+}
+
+// RepoFile is the rendered contents of an output, ready to be written to the repository
+type RepoFile struct {
+	Path     string
+	Contents []byte
+}
+
+// FileChange reports what writing a file did to the repository
+type FileChange struct {
+	Path   string
+	Status string
+}
+
+// parseBadgeOutputs parses the outputs written to a repository, as given by the BADGE_OUTPUTS env var or a target's outputs: a
+// comma separated list of kind:path entries such as badge-png:img/carbon-wren.png,stats-json:img/wren-stats.json,readme-region:README.md.
+// A badge-png entry can be resized by giving a width, as in badge-png@150:img/carbon-wren-small.png
+func parseBadgeOutputs(raw string) ([]BadgeOutput, error) {
+	outputs := []BadgeOutput{}
+	for _, entry := range getEnvListFrom(raw) {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("BADGE_OUTPUTS entries must be kind:path, got: %s", entry)
+		}
+
+		output := BadgeOutput{Kind: parts[0], Path: strings.TrimPrefix(parts[1], "/")}
+
+		if kind := strings.SplitN(output.Kind, "@", 2); len(kind) == 2 {
+			width, err := strconv.Atoi(kind[1])
+			if err != nil || width <= 0 || kind[0] != OUTPUT_BADGE_PNG {
+				return nil, fmt.Errorf("Only badge-png outputs can be resized, with a positive width, got: %s", entry)
+			}
+			output.Kind = kind[0]
+			output.Width = width
+		}
+
+		switch output.Kind {
+		case OUTPUT_BADGE_PNG, OUTPUT_BADGE_SVG, OUTPUT_STATS_JSON, OUTPUT_README_REGION:
+		default:
+			return nil, fmt.Errorf("Unknown BADGE_OUTPUTS kind %s, expected %s, %s, %s or %s",
+				output.Kind, OUTPUT_BADGE_PNG, OUTPUT_BADGE_SVG, OUTPUT_STATS_JSON, OUTPUT_README_REGION)
+		}
+
+		outputs = append(outputs, output)
+	}
+
+	if len(outputs) == 0 {
+		return nil, fmt.Errorf("BADGE_OUTPUTS must list at least one output")
+	}
+
+	return outputs, nil
+}
+
+// primaryBadgePath is the full size badge image the visual regression check compares against
+func primaryBadgePath(outputs []BadgeOutput) string {
+	for _, output := range outputs {
+		if output.Kind == OUTPUT_BADGE_PNG && output.Width == 0 {
+			return output.Path
+		}
+	}
+	return BADGE_REPO_PATH
+}
+
+// renderOutputs renders the contents of every output. readExisting returns a file's current contents in the repository, and
+// whether it exists, since a readme-region output only replaces part of its file
+func renderOutputs(outputs []BadgeOutput, run *Run, readExisting func(string) ([]byte, bool, error)) ([]RepoFile, error) {
+	badge, err := ioutil.ReadFile(EXTRACTED_BADGE_IMAGE_LOCAL_PATH)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []RepoFile{}
+	for _, output := range outputs {
+		var contents []byte
+
+		switch output.Kind {
+		case OUTPUT_BADGE_PNG:
+			contents = badge
+			if output.Width > 0 {
+				contents, err = resizeBadge(badge, output.Width)
+			}
+		case OUTPUT_BADGE_SVG:
+			contents = badgeSVG(run.Stats, defaultTheme)
+		case OUTPUT_STATS_JSON:
+			contents, err = json.MarshalIndent(run.Stats, "", "  ")
+		case OUTPUT_README_REGION:
+			existing, found, readErr := readExisting(output.Path)
+			if readErr != nil {
+				return nil, readErr
+			}
+			if !found {
+				return nil, fmt.Errorf("%s does not exist, so its badge region can't be updated", output.Path)
+			}
+			contents, err = replaceReadmeRegion(existing, readmeSnippet(outputs, run.Stats, output))
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Error rendering %s output %s: %v", output.Kind, output.Path, err)
+		}
+
+		files = append(files, RepoFile{Path: output.Path, Contents: contents})
+	}
+
+	return files, nil
+}
+
+// fileStatus compares a file's new contents with what is currently in the repository. A badge image that only differs in the
+// provenance embedded in it, which names the run that rendered it, is unchanged
+func fileStatus(contents, existing []byte, found bool) string {
+	switch {
+	case !found:
+		return FILE_ADDED
+	case bytes.Equal(contents, existing), samePNGImage(contents, existing):
+		return FILE_UNCHANGED
+	default:
+		return FILE_MODIFIED
+	}
+}
+
+// writeRepoFiles writes the rendered files into the worktree's filesystem, creating any missing directories, and reports
+// whether each file was added, modified or left unchanged
+func writeRepoFiles(fs billy.Filesystem, files []RepoFile) ([]FileChange, error) {
+	changes := []FileChange{}
+
+	for _, file := range files {
+		existing, found, err := readBillyFile(fs, file.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		status := fileStatus(file.Contents, existing, found)
+		changes = append(changes, FileChange{Path: file.Path, Status: status})
+
+		if status == FILE_UNCHANGED {
+			continue
+		}
+
+		if err := fs.MkdirAll(path.Dir(file.Path), 0755); err != nil {
+			return nil, err
+		}
+
+		out, err := fs.Create(file.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := out.Write(file.Contents); err != nil {
+			out.Close()
+			return nil, err
+		}
+
+		if err := out.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	return changes, nil
+}
+
+// readBillyFile reads a file from the worktree's filesystem, reporting false if it doesn't exist
+func readBillyFile(fs billy.Filesystem, filePath string) ([]byte, bool, error) {
+	file, err := fs.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	defer file.Close()
+
+	contents, err := ioutil.ReadAll(file)
+	return contents, err == nil, err
+}
+
+// logFileChanges prints what happened to each file written to the repository
+func logFileChanges(changes []FileChange) {
+	for _, change := range changes {
+		fmt.Printf("%s: %s\n", change.Path, change.Status)
+	}
+}
+
+// hasChanges reports whether any file was added or modified
+func hasChanges(changes []FileChange) bool {
+	for _, change := range changes {
+		if change.Status != FILE_UNCHANGED {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceReadmeRegion swaps whatever is between the README_REGION_START and README_REGION_END markers for snippet
+func replaceReadmeRegion(existing []byte, snippet string) ([]byte, error) {
+	text := string(existing)
+
+	start := strings.Index(text, README_REGION_START)
+	end := strings.Index(text, README_REGION_END)
+	if start == -1 || end == -1 || end < start {
+		return nil, fmt.Errorf("Missing %s and %s markers", README_REGION_START, README_REGION_END)
+	}
+
+	return []byte(text[:start+len(README_REGION_START)] + "\n" + snippet + "\n" + text[end:]), nil
+}
+
+// readmeSnippet is the markdown placed in a README region: the badge image, linking to Wren, and its headline stat. An image
+// embedded from its ImageURL is left on its own, so that the README only changes when the address of the image does
+func readmeSnippet(outputs []BadgeOutput, stats BadgeStats, readme BadgeOutput) string {
+	if readme.ImageURL != "" {
+		return fmt.Sprintf("[![Wren badge](%s)](%s)", readme.ImageURL, WrenBadgeURL)
+	}
+
+	// Link to the badge image relative to the README, so the snippet works wherever the README lives in the repository
+	badgePath := primaryBadgePath(outputs)
+	if dir := path.Dir(readme.Path); dir != "." {
+		badgePath = strings.Repeat("../", len(strings.Split(dir, "/"))) + badgePath
+	}
+
+	snippet := fmt.Sprintf("[![Wren badge](%s)](%s)", badgePath, WrenBadgeURL)
+	if stats.Tons != "" {
+		snippet += fmt.Sprintf("\n\n%s", stats.Tons)
+	}
+	return snippet
+}
+
+// badgeSVG draws the badge as a vector SVG from its stats, following the layout of the wrapper template's CSS: the headline
+// above the tons pill, on the theme's background, titled with the stats for screen readers. Unlike the PNG, it is the same
+// from one run to the next until the stats change, and stays sharp at any size
+func badgeSVG(stats BadgeStats, theme BadgeTheme) []byte {
+	title := strings.TrimSpace(strings.Join([]string{stats.Headline, stats.Tons}, " "))
+	if title == "" {
+		title = "Wren badge"
+	}
+
+	// The pill is sized to its text, with Roboto at 12px averaging about 7px per character, plus 4px of padding either side
+	pillWidth := 7*len([]rune(stats.Tons)) + 8
+
+	svg := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" role="img" aria-label="%s">
+  <title>%s</title>
+  <rect width="%d" height="%d" fill="%s"/>
+  <g font-family="Roboto, Helvetica, Arial, sans-serif">
+    <text x="16" y="54" fill="#ffffff" font-size="21" font-weight="700">%s</text>
+    <rect x="16" y="65" width="%d" height="18" rx="2" fill="#ffffff"/>
+    <text x="20" y="78" fill="%s" font-size="12">%s</text>
+  </g>
+</svg>
+`, theme.Width, theme.Height, theme.Width, theme.Height, html.EscapeString(title), html.EscapeString(title),
+		theme.Width, theme.Height, theme.BackgroundColor, html.EscapeString(stats.Headline),
+		pillWidth, theme.BackgroundColor, html.EscapeString(stats.Tons))
+
+	return []byte(svg)
+}
+
+// resizeBadge scales the badge to width pixels wide, keeping its aspect ratio. Each output pixel averages the block of source
+// pixels it covers, which keeps the badge's text legible when it is shrunk
+func resizeBadge(badge []byte, width int) ([]byte, error) {
+	src, err := png.Decode(bytes.NewReader(badge))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+pr, g+pg, b+pb, a+pa, n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+
+	var out bytes.Buffer
+	encoder := &png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&out, dst); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBadgeSVG(t *testing.T) {
+	stats := BadgeStats{Headline: "Zack & co", Tons: "12.5 tons <offset>", TonsOffset: 12.5}
+
+	svg := badgeSVG(stats, defaultTheme)
+
+	// The SVG is a well formed XML document, with the stats escaped
+	decoder := xml.NewDecoder(bytes.NewReader(svg))
+	texts := []string{}
+	inText := false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if err != io.EOF {
+				t.Fatalf("badgeSVG() isn't well formed XML: %v\n%s", err, svg)
+			}
+			break
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			inText = token.Name.Local == "text"
+			if token.Name.Local == "image" {
+				t.Errorf("badgeSVG() embeds an image rather than drawing the badge")
+			}
+		case xml.CharData:
+			if inText {
+				texts = append(texts, string(token))
+			}
+		case xml.EndElement:
+			inText = false
+		}
+	}
+	if strings.Join(texts, "|") != "Zack & co|12.5 tons <offset>" {
+		t.Errorf("badgeSVG() draws the text %q", texts)
+	}
+
+	if !strings.Contains(string(svg), `width="300" height="117"`) || !strings.Contains(string(svg), defaultTheme.BackgroundColor) {
+		t.Errorf("badgeSVG() isn't drawn in the theme's size and colors:\n%s", svg)
+	}
+
+	// The same stats always draw the same SVG, so an unchanged badge isn't committed again
+	if !bytes.Equal(svg, badgeSVG(stats, defaultTheme)) {
+		t.Errorf("badgeSVG() isn't deterministic")
+	}
+}
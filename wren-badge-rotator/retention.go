@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DEFAULT_DEBUG_RETENTION_DAYS is how long debug artifacts are kept when RETENTION_DEBUG_DAYS is not set
+	DEFAULT_DEBUG_RETENTION_DAYS = 90
+	// DEFAULT_FAILED_RUNS_KEPT is how many of the most recent failed runs are kept when RETENTION_KEEP_FAILED_RUNS is not set
+	DEFAULT_FAILED_RUNS_KEPT = 5
+	// DELETE_BATCH_SIZE is the most keys deleted per request, matching the limit of S3's DeleteObjects API
+	DELETE_BATCH_SIZE = 1000
+)
+
+// RetentionPolicy decides which archived artifacts are kept. The final badge of every month, the last delivered one, is always
+// kept, since it is the history the archive exists for. Everything else a delivered run stores is a debug artifact, kept for
+// DebugRetention. A run that failed, either part way through before it made it into the manifest or because its badge wasn't
+// delivered, is only kept if it is one of the most recent KeepFailedRuns failures
+type RetentionPolicy struct {
+	DebugRetention time.Duration
+	KeepFailedRuns int
+}
+
+// BatchDeleter is implemented by stores that can delete many keys in a single request
+type BatchDeleter interface {
+	DeleteKeys(keys []string) error
+}
+
+// getRetentionPolicy reads the retention policy from the RETENTION_DEBUG_DAYS and RETENTION_KEEP_FAILED_RUNS env vars
+func getRetentionPolicy() (RetentionPolicy, error) {
+	debugDays, err := getEnvInt("RETENTION_DEBUG_DAYS", DEFAULT_DEBUG_RETENTION_DAYS)
+	if err != nil {
+		return RetentionPolicy{}, err
+	}
+
+	keepFailed, err := getEnvInt("RETENTION_KEEP_FAILED_RUNS", DEFAULT_FAILED_RUNS_KEPT)
+	if err != nil {
+		return RetentionPolicy{}, err
+	}
+
+	return RetentionPolicy{
+		DebugRetention: time.Duration(debugDays) * 24 * time.Hour,
+		KeepFailedRuns: keepFailed,
+	}, nil
+}
+
+// archivedRun groups the stored keys that belong to a single run
+type archivedRun struct {
+	id        string
+	month     string
+	startedAt time.Time
+	keys      []string
+}
+
+// parseRunKey splits a key such as runs/2026-10/<run-id>/badge.png into its month, run ID and artifact name
+func parseRunKey(key string) (month, runID, name string, ok bool) {
+	parts := strings.SplitN(strings.TrimPrefix(key, RUNS_PREFIX), "/", 3)
+	if !strings.HasPrefix(key, RUNS_PREFIX) || len(parts) != 3 {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
+
+// expiredKeys works out which archived keys the policy no longer keeps, as of now
+func expiredKeys(store ArtifactStore, manifest *Manifest, policy RetentionPolicy, now time.Time) ([]string, error) {
+	keys, err := store.List(RUNS_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := map[string]*archivedRun{}
+	for _, key := range keys {
+		month, runID, _, ok := parseRunKey(key)
+		if !ok {
+			continue
+		}
+		run, seen := runs[runID]
+		if !seen {
+			// Run IDs start with the time the run started, so the start time survives even if the manifest doesn't
+			startedAt, parseErr := time.Parse("20060102T150405Z", strings.SplitN(runID, "-", 2)[0])
+			if parseErr != nil {
+				fmt.Printf("Skipping archived run with unrecognized ID: %s\n", runID)
+				continue
+			}
+			run = &archivedRun{id: runID, month: month, startedAt: startedAt}
+			runs[runID] = run
+		}
+		run.keys = append(run.keys, key)
+	}
+
+	// The final badge of each month is the last delivered run of that month
+	delivered := map[string]bool{}
+	finals := map[string]string{}
+	for _, run := range manifest.Runs {
+		if !run.delivered() {
+			continue
+		}
+		delivered[run.ID] = true
+		month := run.StartedAt.UTC().Format("2006-01")
+		if current, ok := finals[month]; !ok || run.ID > current {
+			finals[month] = run.ID
+		}
+	}
+	isFinal := map[string]bool{}
+	for _, runID := range finals {
+		isFinal[runID] = true
+	}
+
+	var failed []*archivedRun
+	expired := []string{}
+
+	for _, run := range runs {
+		if !delivered[run.id] {
+			failed = append(failed, run)
+			continue
+		}
+
+		if now.Sub(run.startedAt) < policy.DebugRetention {
+			continue
+		}
+
+		for _, key := range run.keys {
+			_, _, name, _ := parseRunKey(key)
+			// The final badge image of each month is kept forever, everything else is a debug artifact
+			if isFinal[run.id] && name == ARTIFACT_BADGE_PNG {
+				continue
+			}
+			expired = append(expired, key)
+		}
+	}
+
+	// Keep only the most recent failed runs
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].id > failed[j].id
+	})
+	for i, run := range failed {
+		if i < policy.KeepFailedRuns {
+			continue
+		}
+		expired = append(expired, run.keys...)
+	}
+
+	sort.Strings(expired)
+	return expired, nil
+}
+
+// pruneArtifacts deletes every archived artifact the retention policy no longer keeps, in batches. With dryRun set it only
+// prints what would be deleted. Runs whose artifacts are all deleted are also dropped from the manifest
+func pruneArtifacts(store ArtifactStore, policy RetentionPolicy, dryRun bool) error {
+	manifest, err := loadManifest(store)
+	if err != nil {
+		return err
+	}
+
+	expired, err := expiredKeys(store, manifest, policy, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if len(expired) == 0 {
+		fmt.Println("No expired artifacts to prune")
+		return nil
+	}
+
+	for _, key := range expired {
+		if dryRun {
+			fmt.Printf("Would delete: %s\n", key)
+		} else {
+			fmt.Printf("Deleting: %s\n", key)
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("Dry run: %d expired artifacts would be deleted\n", len(expired))
+		return nil
+	}
+
+	for start := 0; start < len(expired); start += DELETE_BATCH_SIZE {
+		end := start + DELETE_BATCH_SIZE
+		if end > len(expired) {
+			end = len(expired)
+		}
+		if err := deleteKeys(store, expired[start:end]); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Deleted %d expired artifacts\n", len(expired))
+
+	// Drop runs that no longer have anything left in the archive from the manifest
+	remaining, err := store.List(RUNS_PREFIX)
+	if err != nil {
+		return err
+	}
+
+	remainingRuns := map[string]bool{}
+	for _, key := range remaining {
+		if _, runID, _, ok := parseRunKey(key); ok {
+			remainingRuns[runID] = true
+		}
+	}
+
+	kept := []Run{}
+	for _, run := range manifest.Runs {
+		if remainingRuns[run.ID] {
+			kept = append(kept, run)
+		}
+	}
+
+	if len(kept) == len(manifest.Runs) {
+		return nil
+	}
+
+	manifest.Runs = kept
+	if err := saveManifest(store, manifest); err != nil {
+		return err
+	}
+
+	// The gallery is built from the manifest, so it would otherwise still link to the deleted runs
+	return publishGallery(store)
+}
+
+// deleteKeys deletes a batch of keys with a single request when the store supports it, or one at a time otherwise
+func deleteKeys(store ArtifactStore, keys []string) error {
+	if batcher, ok := store.(BatchDeleter); ok {
+		return batcher.DeleteKeys(keys)
+	}
+
+	for _, key := range keys {
+		if err := store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
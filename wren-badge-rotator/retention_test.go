@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpiredKeysOnlyKeepsDeliveredFinals(t *testing.T) {
+	store := newMemoryArtifactStore()
+
+	archive := func(day int, delivered bool) *Run {
+		run, err := newRun(time.Date(2026, 9, day, 8, 0, 0, 0, time.UTC), "zackproser")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{ARTIFACT_SOURCE_HTML, ARTIFACT_BADGE_PNG} {
+			if err := run.archiveArtifact(store, name, strings.NewReader(name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := publishRun(store, run, delivered); err != nil {
+			t.Fatal(err)
+		}
+		return run
+	}
+
+	early := archive(1, true)
+	final := archive(15, true)
+	// A run that was published but whose delivery failed, or was blocked by the visual diff gate, is last in the month
+	blocked := archive(30, false)
+
+	manifest, err := loadManifest(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2027, 3, 1, 0, 0, 0, 0, time.UTC)
+	policy := RetentionPolicy{DebugRetention: 90 * 24 * time.Hour, KeepFailedRuns: 1}
+
+	expired, err := expiredKeys(store, manifest, policy, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{early.key(ARTIFACT_BADGE_PNG), early.key(ARTIFACT_SOURCE_HTML), final.key(ARTIFACT_SOURCE_HTML)}
+	sort.Strings(want)
+	if !reflect.DeepEqual(expired, want) {
+		t.Errorf("expiredKeys() = %v, want %v", expired, want)
+	}
+
+	// Once the failed run is no longer among the most recent failures, it is pruned entirely, while the delivered final stays
+	policy.KeepFailedRuns = 0
+	expired, err = expiredKeys(store, manifest, policy, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, blocked.key(ARTIFACT_BADGE_PNG), blocked.key(ARTIFACT_SOURCE_HTML))
+	sort.Strings(want)
+	if !reflect.DeepEqual(expired, want) {
+		t.Errorf("With no failed runs kept, expiredKeys() = %v, want %v", expired, want)
+	}
+}
@@ -1,99 +1,330 @@
 package main
 
 import (
-	"bytes"
+	"crypto/md5"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
-// Upload takes a local sourch path and a remote S3 path and uploads the file at the sourcePath to the destPath in S3
-func Upload(s *session.Session, sourcePath, destPath string) error {
+// S3UploadPolicy is the metadata applied to every object this tool writes to S3
+type S3UploadPolicy struct {
+	// CacheControl is the default Cache-Control header, used when an artifact doesn't set its own
+	CacheControl string
+	// ServerSideEncryption is either empty, "AES256" for SSE-S3, or "aws:kms" for SSE-KMS
+	ServerSideEncryption string
+	// KMSKeyID is the KMS key used when ServerSideEncryption is "aws:kms", or empty to use the AWS managed key
+	KMSKeyID string
+	// Tags are attached to every object as S3 object tags
+	Tags map[string]string
+}
 
-	file, err := os.Open(sourcePath)
-	if err != nil {
-		return err
+// getS3UploadPolicy reads the upload policy from the S3_CACHE_CONTROL, S3_SSE, S3_SSE_KMS_KEY_ID and S3_OBJECT_TAGS env vars.
+// S3_OBJECT_TAGS is a comma separated list of key=value pairs
+func getS3UploadPolicy() (S3UploadPolicy, error) {
+	policy := S3UploadPolicy{
+		CacheControl:         os.Getenv("S3_CACHE_CONTROL"),
+		ServerSideEncryption: os.Getenv("S3_SSE"),
+		KMSKeyID:             os.Getenv("S3_SSE_KMS_KEY_ID"),
+		Tags:                 map[string]string{},
 	}
 
-	defer file.Close()
+	switch policy.ServerSideEncryption {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+	default:
+		return S3UploadPolicy{}, fmt.Errorf("S3_SSE must be %s or %s, got: %s", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms, policy.ServerSideEncryption)
+	}
 
-	fileInfo, _ := file.Stat()
-	var size int64 = fileInfo.Size()
-	buffer := make([]byte, size)
-	file.Read(buffer)
+	if policy.KMSKeyID != "" && policy.ServerSideEncryption != s3.ServerSideEncryptionAwsKms {
+		return S3UploadPolicy{}, fmt.Errorf("S3_SSE_KMS_KEY_ID requires S3_SSE to be %s", s3.ServerSideEncryptionAwsKms)
+	}
 
-	_, err = s3.New(s).PutObject(&s3.PutObjectInput{
-		Bucket:        aws.String(S3_BUCKET),
-		Key:           aws.String(destPath),
-		Body:          bytes.NewReader(buffer),
-		ContentLength: aws.Int64(size),
-		ContentType:   aws.String(http.DetectContentType(buffer)),
-	})
-	return err
+	for _, pair := range strings.Split(os.Getenv("S3_OBJECT_TAGS"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return S3UploadPolicy{}, fmt.Errorf("S3_OBJECT_TAGS entries must be key=value, got: %s", pair)
+		}
+		policy.Tags[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return policy, nil
 }
 
-// uploadHTMLBagdeToS3 takes the modified HTML page and hosts it live via the public S3 bucket so that the HCTI API
-// will be able to fetch it and extract the badge image from it
-func uploadHTMLBadgeToS3() error {
-	s, err := session.NewSession(&aws.Config{Region: aws.String(S3_REGION)})
+// tagging encodes the policy's tags as the URL query string S3 expects
+func (p S3UploadPolicy) tagging() string {
+	keys := make([]string, 0, len(p.Tags))
+	for key := range p.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := url.Values{}
+	for _, key := range keys {
+		values.Set(key, p.Tags[key])
+	}
+	return values.Encode()
+}
+
+// S3Connection describes how to reach the bucket artifacts are stored in. Only Bucket and Region are needed for AWS itself,
+// the remaining fields allow the store to run against MinIO or another S3-compatible service
+type S3Connection struct {
+	Bucket string
+	Region string
+	// Endpoint is the base URL of an S3-compatible service, such as http://localhost:9000
+	Endpoint string
+	// ForcePathStyle addresses objects as <endpoint>/<bucket>/<key> instead of using a bucket subdomain
+	ForcePathStyle bool
+	// AccessKeyID and SecretAccessKey are static credentials, used instead of the default AWS credential chain when set
+	AccessKeyID     string
+	SecretAccessKey string
+	// PublicBaseURL is the address objects are publicly served from, such as a CDN, used to build public object URLs
+	PublicBaseURL string
+}
+
+// getS3Connection reads the bucket connection from S3_BUCKET and AWS_REGION, plus the optional S3_ENDPOINT,
+// S3_FORCE_PATH_STYLE, S3_ACCESS_KEY_ID, S3_SECRET_ACCESS_KEY and S3_PUBLIC_BASE_URL env vars
+func getS3Connection() (S3Connection, error) {
+	conn := S3Connection{
+		Bucket:          S3_BUCKET,
+		Region:          S3_REGION,
+		Endpoint:        os.Getenv("S3_ENDPOINT"),
+		ForcePathStyle:  getEnvBool("S3_FORCE_PATH_STYLE"),
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		PublicBaseURL:   strings.TrimSuffix(os.Getenv("S3_PUBLIC_BASE_URL"), "/"),
+	}
+
+	if (conn.AccessKeyID == "") != (conn.SecretAccessKey == "") {
+		return S3Connection{}, errors.New("S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY must be set together")
+	}
+
+	// S3-compatible services generally ignore the region, but the SDK still requires one to sign requests
+	if conn.Region == "" && conn.Endpoint != "" {
+		conn.Region = "us-east-1"
+	}
+
+	return conn, nil
+}
+
+// S3ArtifactStore stores artifacts in the project's S3 bucket, or a bucket on an S3-compatible service
+type S3ArtifactStore struct {
+	client *s3.S3
+	conn   S3Connection
+	policy S3UploadPolicy
+}
+
+// newS3ArtifactStore creates a single S3 session that is shared by every artifact read and write during the run
+func newS3ArtifactStore(conn S3Connection, policy S3UploadPolicy) (*S3ArtifactStore, error) {
+	config := &aws.Config{
+		Region:           aws.String(conn.Region),
+		S3ForcePathStyle: aws.Bool(conn.ForcePathStyle),
+	}
+
+	if conn.Endpoint != "" {
+		config.Endpoint = aws.String(conn.Endpoint)
+	}
+
+	if conn.AccessKeyID != "" {
+		config.Credentials = credentials.NewStaticCredentials(conn.AccessKeyID, conn.SecretAccessKey, "")
+	}
+
+	s, err := session.NewSession(config)
 	if err != nil {
 		fmt.Printf("Error creating S3 session %+v\n", err)
-		return err
+		return nil, err
+	}
+
+	return &S3ArtifactStore{
+		client: s3.New(s),
+		conn:   conn,
+		policy: policy,
+	}, nil
+}
+
+// Put streams body to key in the bucket. The body's MD5 is sent as Content-MD5 so that S3 rejects the upload if anything
+// was corrupted in transit. Bodies that can't be rewound after hashing are spooled to a temporary file first, rather than
+// being held in memory
+func (s *S3ArtifactStore) Put(key string, body io.Reader, opts PutOptions) error {
+	seeker, ok := body.(io.ReadSeeker)
+	if !ok {
+		spool, err := ioutil.TempFile("", "wren-badge-artifact")
+		if err != nil {
+			return err
+		}
+
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+
+		if _, err := io.Copy(spool, body); err != nil {
+			return err
+		}
+		seeker = spool
 	}
 
-	err = Upload(s, BADGE_LOCAL_PATH, HTML_PAGE_DEST_S3_PATH)
+	// Hash from wherever the body is currently positioned, then rewind to that point for the upload itself
+	start, err := seeker.Seek(0, io.SeekCurrent)
 	if err != nil {
-		fmt.Printf("Error uploading to S3 %+v\n", err)
 		return err
 	}
-	return nil
-}
 
-// copyExtractedBadgeImageToS3 takes in the URL that was returned by the HCTI API, where the extracted, updated badge is hosted,
-// and reads then write it to a local file first. Next, it uploads the local file to a special S3 prefix /extracted for
-// safe keeping and sanity checking - even though this S3 hosted badge is not used itself - you could also link to it
-// directly and then just keep running this or a similar function to update it in place if you did not want to go through
-// the hassle of programmatically handling the git / Github operations
-func copyExtractedBadgeImageToS3(resizedImageURL string) error {
-	s, err := session.NewSession(&aws.Config{Region: aws.String(S3_REGION)})
+	hash := md5.New()
+	size, err := io.Copy(hash, seeker)
 	if err != nil {
-		fmt.Printf("Error creating S3 session: %+v\n", err)
 		return err
 	}
 
-	response, err := http.Get(resizedImageURL)
-	if err != nil {
+	if _, err := seeker.Seek(start, io.SeekStart); err != nil {
 		return err
 	}
 
-	defer response.Body.Close()
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(s.conn.Bucket),
+		Key:           aws.String(key),
+		Body:          seeker,
+		ContentLength: aws.Int64(size),
+		ContentMD5:    aws.String(base64.StdEncoding.EncodeToString(hash.Sum(nil))),
+		ContentType:   aws.String(opts.ContentType),
+	}
 
-	if response.StatusCode != 200 {
-		return errors.New("Received non 200 response code from HCTI API")
+	cacheControl := opts.CacheControl
+	if cacheControl == "" {
+		cacheControl = s.policy.CacheControl
+	}
+	if cacheControl != "" {
+		input.CacheControl = aws.String(cacheControl)
 	}
 
-	file, err := os.Create(EXTRACTED_BADGE_IMAGE_LOCAL_PATH)
-	if err != nil {
-		return err
+	if s.policy.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(s.policy.ServerSideEncryption)
+	}
+	if s.policy.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s.policy.KMSKeyID)
 	}
 
-	defer file.Close()
+	if len(s.policy.Tags) > 0 {
+		input.Tagging = aws.String(s.policy.tagging())
+	}
 
-	_, err = io.Copy(file, response.Body)
+	_, err = s.client.PutObject(input)
+	return err
+}
+
+// Get downloads the object stored at key
+func (s *S3ArtifactStore) Get(key string) ([]byte, error) {
+	out, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.conn.Bucket),
+		Key:    aws.String(key),
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = Upload(s, EXTRACTED_BADGE_IMAGE_LOCAL_PATH, EXTRACTED_BADGE_IMAGE_S3_PATH)
+	defer out.Body.Close()
+
+	return ioutil.ReadAll(out.Body)
+}
+
+// List pages through every object in the bucket whose key starts with prefix
+func (s *S3ArtifactStore) List(prefix string) ([]string, error) {
+	keys := []string{}
+	err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.conn.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, aws.StringValue(object.Key))
+		}
+		return true
+	})
+	return keys, err
+}
+
+// Delete removes the object stored at key
+func (s *S3ArtifactStore) Delete(key string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.conn.Bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// DeleteKeys removes up to 1000 objects with a single DeleteObjects request
+func (s *S3ArtifactStore) DeleteKeys(keys []string) error {
+	objects := make([]*s3.ObjectIdentifier, 0, len(keys))
+	for _, key := range keys {
+		objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+	}
+
+	out, err := s.client.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(s.conn.Bucket),
+		Delete: &s3.Delete{
+			Objects: objects,
+			Quiet:   aws.Bool(true),
+		},
+	})
 	if err != nil {
 		return err
 	}
 
+	if len(out.Errors) > 0 {
+		return fmt.Errorf("Failed to delete %d objects, first error on %s: %s", len(out.Errors), aws.StringValue(out.Errors[0].Key), aws.StringValue(out.Errors[0].Message))
+	}
 	return nil
 }
+
+// PresignedURL returns a GET URL for key that is signed with the Lambda function's credentials and expires after ttl, so the
+// object can be fetched without the bucket being public. A URL signed with temporary credentials, such as the Lambda
+// function's role session, stops working when they expire, so the time returned is whichever comes first
+func (s *S3ArtifactStore) PresignedURL(key string, ttl time.Duration) (string, time.Time, error) {
+	signedAt := time.Now()
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.conn.Bucket),
+		Key:    aws.String(key),
+	})
+	url, err := req.Presign(ttl)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expires := signedAt.Add(ttl)
+	// Static credentials never expire, and their provider reports an error here
+	if credentialsExpire, err := s.client.Config.Credentials.ExpiresAt(); err == nil && !credentialsExpire.IsZero() && credentialsExpire.Before(expires) {
+		expires = credentialsExpire
+	}
+
+	return url, expires, nil
+}
+
+// URL returns the public address of key, which anonymous principals can read when the bucket policy allows it
+func (s *S3ArtifactStore) URL(key string) string {
+	key = strings.TrimPrefix(key, "/")
+
+	switch {
+	case s.conn.PublicBaseURL != "":
+		return fmt.Sprintf("%s/%s", s.conn.PublicBaseURL, key)
+	case s.conn.Endpoint != "" && s.conn.ForcePathStyle:
+		return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(s.conn.Endpoint, "/"), s.conn.Bucket, key)
+	case s.conn.Endpoint != "":
+		endpoint, err := url.Parse(s.conn.Endpoint)
+		if err == nil {
+			return fmt.Sprintf("%s://%s.%s/%s", endpoint.Scheme, s.conn.Bucket, endpoint.Host, key)
+		}
+	}
+
+	return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s.conn.Bucket, key)
+}
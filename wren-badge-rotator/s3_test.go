@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// TestS3ArtifactStoreMinIO runs the store round trip against a real S3-compatible service. It is skipped unless MINIO_ENDPOINT
+// points at one, such as a local MinIO started with:
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//
+// MINIO_ACCESS_KEY and MINIO_SECRET_KEY default to MinIO's out of the box credentials, and MINIO_BUCKET, created if need be,
+// defaults to wren-badge-rotator-test
+func TestS3ArtifactStoreMinIO(t *testing.T) {
+	endpoint := os.Getenv("MINIO_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("Set MINIO_ENDPOINT to run against MinIO")
+	}
+
+	conn := S3Connection{
+		Bucket:          getEnvString("MINIO_BUCKET", "wren-badge-rotator-test"),
+		Region:          "us-east-1",
+		Endpoint:        endpoint,
+		ForcePathStyle:  true,
+		AccessKeyID:     getEnvString("MINIO_ACCESS_KEY", "minioadmin"),
+		SecretAccessKey: getEnvString("MINIO_SECRET_KEY", "minioadmin"),
+	}
+
+	store, err := newS3ArtifactStore(conn, S3UploadPolicy{Tags: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(conn.Bucket)})
+	if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou || aerr.Code() == s3.ErrCodeBucketAlreadyExists) {
+		err = nil
+	}
+	if err != nil {
+		t.Fatalf("Creating bucket %s: %v", conn.Bucket, err)
+	}
+
+	// Keep each run's objects apart, in case the bucket is shared or an earlier run was interrupted
+	testArtifactStoreRoundTrip(t, store, fmt.Sprintf("test-%d/", time.Now().UnixNano()))
+
+	url, expires, err := store.PresignedURL("test/badge.png", time.Minute)
+	if err != nil {
+		t.Fatalf("PresignedURL: %v", err)
+	}
+	if expires.After(time.Now().Add(time.Minute)) {
+		t.Errorf("PresignedURL expires at %s, after its TTL", expires)
+	}
+	t.Logf("Presigned %s, expiring at %s", url, expires)
+}
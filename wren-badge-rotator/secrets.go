@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// getSecretString reads the string value of an AWS Secrets Manager secret, which is how private keys are kept out of the
+// Lambda's configuration
+func getSecretString(secretID string) (string, error) {
+	s, err := session.NewSession(&aws.Config{Region: aws.String(S3_REGION)})
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := secretsmanager.New(s).GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(secret.SecretString), nil
+}
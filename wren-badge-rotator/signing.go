@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// getArmoredSigningKey returns the ASCII-armored OpenPGP private key badge commits are signed with, read either directly from
+// the COMMIT_SIGNING_KEY env var, or from the AWS Secrets Manager secret named by COMMIT_SIGNING_KEY_SECRET_ID, which keeps
+// the key out of the Lambda's configuration. It returns an empty string when commit signing is not configured
+func getArmoredSigningKey() (string, error) {
+	if key := os.Getenv("COMMIT_SIGNING_KEY"); key != "" {
+		return key, nil
+	}
+
+	secretID := os.Getenv("COMMIT_SIGNING_KEY_SECRET_ID")
+	if secretID == "" {
+		return "", nil
+	}
+
+	key, err := getSecretString(secretID)
+	if err != nil {
+		return "", fmt.Errorf("Error reading commit signing key from secret %s: %v", secretID, err)
+	}
+
+	return key, nil
+}
+
+// commitSigningConfigured reports whether badge commits must be signed, which only the clone method can do with the key
+func commitSigningConfigured() bool {
+	return os.Getenv("COMMIT_SIGNING_KEY") != "" || os.Getenv("COMMIT_SIGNING_KEY_SECRET_ID") != ""
+}
+
+// getCommitSigningKey parses and decrypts the configured signing key, returning nil when commit signing is not configured.
+// A passphrase protected key is decrypted with COMMIT_SIGNING_KEY_PASSPHRASE
+func getCommitSigningKey() (*openpgp.Entity, error) {
+	armoredKey, err := getArmoredSigningKey()
+	if err != nil || armoredKey == "" {
+		return nil, err
+	}
+
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armoredKey))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing commit signing key: %v", err)
+	}
+
+	if len(entities) == 0 || entities[0].PrivateKey == nil {
+		return nil, errors.New("The commit signing key must be an OpenPGP private key")
+	}
+
+	entity := entities[0]
+
+	if entity.PrivateKey.Encrypted {
+		passphrase := []byte(os.Getenv("COMMIT_SIGNING_KEY_PASSPHRASE"))
+		if err := entity.PrivateKey.Decrypt(passphrase); err != nil {
+			return nil, fmt.Errorf("Error decrypting commit signing key, check COMMIT_SIGNING_KEY_PASSPHRASE: %v", err)
+		}
+		for _, subkey := range entity.Subkeys {
+			if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+				if err := subkey.PrivateKey.Decrypt(passphrase); err != nil {
+					return nil, fmt.Errorf("Error decrypting commit signing subkey: %v", err)
+				}
+			}
+		}
+	}
+
+	return entity, nil
+}
+
+// verifyCommitSignature checks that the commit at hash carries a valid signature from signKey, so that a commit that the
+// profile repository's branch protection would reject is caught before it is pushed
+func verifyCommitSignature(localRepository *git.Repository, hash plumbing.Hash, signKey *openpgp.Entity) error {
+	commit, err := localRepository.CommitObject(hash)
+	if err != nil {
+		return err
+	}
+
+	if commit.PGPSignature == "" {
+		return fmt.Errorf("Commit %s was not signed", hash)
+	}
+
+	var publicKey bytes.Buffer
+	writer, err := armor.Encode(&publicKey, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+	if err := signKey.Serialize(writer); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	if _, err := commit.Verify(publicKey.String()); err != nil {
+		return fmt.Errorf("Commit %s has an invalid signature: %v", hash, err)
+	}
+
+	fmt.Printf("Verified signature on commit %s\n", hash)
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// armoredTestKey generates an OpenPGP key and returns it along with its ASCII-armored private key
+func armoredTestKey(t *testing.T, name string) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var armored bytes.Buffer
+	writer, err := armor.Encode(&armored, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.SerializePrivate(writer, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return entity, armored.String()
+}
+
+func TestCommitLocalChangesSigned(t *testing.T) {
+	signer, armoredKey := armoredTestKey(t, "Badge Signer")
+	other, _ := armoredTestKey(t, "Someone Else")
+
+	os.Setenv("COMMIT_SIGNING_KEY", armoredKey)
+	defer os.Unsetenv("COMMIT_SIGNING_KEY")
+
+	repo, err := git.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := writeRepoFiles(worktree.Filesystem, []RepoFile{{Path: BADGE_REPO_PATH, Contents: []byte("badge")}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Add(BADGE_REPO_PATH); err != nil {
+		t.Fatal(err)
+	}
+
+	run := &Run{ID: "run", User: "zackproser", StartedAt: time.Date(2026, 10, 2, 8, 0, 0, 0, time.UTC)}
+	hash, err := commitLocalChanges(worktree, repo, run, &Target{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit.PGPSignature == "" {
+		t.Fatal("The commit was not signed")
+	}
+
+	if err := verifyCommitSignature(repo, hash, signer); err != nil {
+		t.Errorf("The signature doesn't verify with the signing key: %v", err)
+	}
+	if err := verifyCommitSignature(repo, hash, other); err == nil {
+		t.Error("The signature verified with a different key")
+	}
+}
+
+func TestRepoUpdateMethodWithSigningKey(t *testing.T) {
+	os.Setenv("COMMIT_SIGNING_KEY", "key")
+	defer os.Unsetenv("COMMIT_SIGNING_KEY")
+	defer os.Unsetenv("REPO_UPDATE_METHOD")
+
+	target := &Target{RepoURL: "https://github.com/zackproser/zackproser.git"}
+
+	os.Unsetenv("REPO_UPDATE_METHOD")
+	if method, err := repoUpdateMethod(target); err != nil || method != "clone" {
+		t.Errorf("Default method with a signing key = %q, %v, want clone", method, err)
+	}
+
+	os.Setenv("REPO_UPDATE_METHOD", "api")
+	if _, err := repoUpdateMethod(target); err == nil {
+		t.Error("The api method should be rejected with a signing key, since it can't use it")
+	}
+}
@@ -2,13 +2,90 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
 )
 
 func sanityCheckEnvVars() error {
 
-	if os.Getenv("GITHUB_OAUTH_TOKEN") == "" || os.Getenv("HCTI_API_KEY") == "" || os.Getenv("HCTI_USER_ID") == "" {
+	if os.Getenv("HCTI_API_KEY") == "" || os.Getenv("HCTI_USER_ID") == "" {
 		return errors.New("Missing required env var")
 	}
+
+	// Which of these is needed depends on the forge hosting the profile repository, or on publishing to a gist, and is checked
+	// when the badge is delivered
+	if os.Getenv("GITHUB_OAUTH_TOKEN") == "" && os.Getenv("GITHUB_APP_ID") == "" && os.Getenv("GITLAB_TOKEN") == "" && os.Getenv("GITEA_TOKEN") == "" && os.Getenv("GIST_TOKEN") == "" {
+		return errors.New("Missing forge credentials env var")
+	}
 	return nil
 }
+
+// getEnvString reads an optional env var, falling back to defaultValue when it is unset
+func getEnvString(name, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvFloat reads an optional numeric env var, falling back to defaultValue when it is unset
+func getEnvFloat(name string, defaultValue float64) (float64, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, fmt.Errorf("The %s env var must be a number, got: %s", name, raw)
+	}
+	return value, nil
+}
+
+// getEnvInt reads an optional integer env var, falling back to defaultValue when it is unset
+func getEnvInt(name string, defaultValue int) (int, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("The %s env var must be an integer, got: %s", name, raw)
+	}
+	return value, nil
+}
+
+// getEnvBool reports whether an optional env var is set to a true value such as "true" or "1"
+func getEnvBool(name string) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	return err == nil && value
+}
+
+// getEnvList reads a comma separated env var, ignoring empty entries
+func getEnvList(name string) []string {
+	return getEnvListFrom(os.Getenv(name))
+}
+
+// getEnvListFrom splits a comma separated value, ignoring empty entries
+func getEnvListFrom(raw string) []string {
+	values := []string{}
+	for _, value := range strings.Split(raw, ",") {
+		if trimmed := strings.TrimSpace(value); trimmed != "" {
+			values = append(values, trimmed)
+		}
+	}
+	return values
+}
+
+// artifactsServedPublicly reports whether the store's artifacts can be read without credentials, so that they can be linked
+// to. Local and in-memory stores are read directly, while a bucket is only public with the legacy public BADGE_HTML_ACCESS
+// mode, which relies on its public read policy, or when S3_PUBLIC_BASE_URL serves it
+func artifactsServedPublicly(store ArtifactStore) bool {
+	if _, private := store.(PresignedURLStore); !private {
+		return true
+	}
+	return getEnvString("BADGE_HTML_ACCESS", "presigned") == "public" || getEnvString("S3_PUBLIC_BASE_URL", "") != ""
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// BadgeStats holds the figures scraped from the Wren badge, so they can be recorded alongside the rendered image
+type BadgeStats struct {
+	// Headline is the badge's .header text, such as the name of the subscriber
+	Headline string `json:"headline"`
+	// Tons is the raw text of the badge's .tons pill
+	Tons string `json:"tons"`
+	// TonsOffset is the number found in the .tons text, or 0 if none could be parsed
+	TonsOffset float64 `json:"tons_offset"`
+}
+
+// numberPattern matches the first number in a string, allowing thousands separators and decimals
+var numberPattern = regexp.MustCompile(`[0-9][0-9,]*(\.[0-9]+)?`)
+
+// extractBadgeStats reads the headline and tons figures out of the badge node found by Badge
+func extractBadgeStats(badge *html.Node) BadgeStats {
+	stats := BadgeStats{}
+
+	if header := findNodeWithClass(badge, "header"); header != nil {
+		stats.Headline = nodeText(header)
+	}
+
+	if tons := findNodeWithClass(badge, "tons"); tons != nil {
+		stats.Tons = nodeText(tons)
+		if match := numberPattern.FindString(stats.Tons); match != "" {
+			stats.TonsOffset, _ = strconv.ParseFloat(strings.Replace(match, ",", "", -1), 64)
+		}
+	}
+
+	return stats
+}
+
+// findNodeWithClass recursively searches for the first element node whose class attribute contains className
+func findNodeWithClass(node *html.Node, className string) *html.Node {
+	if node.Type == html.ElementNode {
+		for _, attr := range node.Attr {
+			if attr.Key != "class" {
+				continue
+			}
+			for _, class := range strings.Fields(attr.Val) {
+				if class == className {
+					return node
+				}
+			}
+		}
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if found := findNodeWithClass(child, className); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// nodeText joins all the text contained in node and its descendants, collapsing whitespace
+func nodeText(node *html.Node) string {
+	var parts []string
+	var collect func(*html.Node)
+	collect = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			parts = append(parts, n.Data)
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			collect(child)
+		}
+	}
+	collect(node)
+	text := strings.Join(strings.Fields(strings.Join(parts, " ")), " ")
+	// Match the badge contents, where the subscript 2 is replaced because it can't be rendered directly
+	return strings.Replace(text, "₂", "2", -1)
+}
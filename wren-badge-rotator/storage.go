@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArtifactStore is where every file produced during a run - the modified badge HTML page, the extracted badge image and the
+// visual diff - is written. The Lambda function stores artifacts in S3, while local runs of the CLI can keep them on disk
+type ArtifactStore interface {
+	// Put streams body to key, replacing anything already stored there
+	Put(key string, body io.Reader, opts PutOptions) error
+	// Get reads the contents stored at key
+	Get(key string) ([]byte, error)
+	// List returns every key that starts with prefix, in lexical order
+	List(prefix string) ([]string, error)
+	// Delete removes key, and is not an error if key does not exist
+	Delete(key string) error
+	// URL returns the address at which key can be read
+	URL(key string) string
+}
+
+// PresignedURLStore is implemented by stores that can hand out short-lived, signed URLs to private artifacts. The URL is
+// returned with the time it actually stops working, which can be sooner than ttl when the signing credentials expire first
+type PresignedURLStore interface {
+	PresignedURL(key string, ttl time.Duration) (string, time.Time, error)
+}
+
+// PutOptions is the metadata stored alongside an artifact
+type PutOptions struct {
+	// ContentType is the MIME type the artifact is served with
+	ContentType string
+	// CacheControl overrides the store's default Cache-Control header for this artifact
+	CacheControl string
+}
+
+// artifactContentTypes maps each kind of artifact this tool produces onto the Content-Type it is served with, rather than
+// guessing from the first bytes of the file, which can report badge.html as plain text
+var artifactContentTypes = map[string]string{
+	".html": "text/html; charset=utf-8",
+	".png":  "image/png",
+	".svg":  "image/svg+xml",
+	".json": "application/json",
+	".md":   "text/markdown; charset=utf-8",
+}
+
+// putOptionsForKey returns the metadata for an artifact based on its file extension
+func putOptionsForKey(key string) PutOptions {
+	contentType, ok := artifactContentTypes[strings.ToLower(path.Ext(key))]
+	if !ok {
+		contentType = "application/octet-stream"
+	}
+	return PutOptions{ContentType: contentType}
+}
+
+// newArtifactStore builds the store selected by the ARTIFACT_STORE env var: "s3" (the default) stores artifacts in S3_BUCKET,
+// "local" stores them in the directory named by ARTIFACT_DIR, and "memory" keeps them in memory for the lifetime of the process
+func newArtifactStore() (ArtifactStore, error) {
+	switch os.Getenv("ARTIFACT_STORE") {
+	case "", "s3":
+		conn, err := getS3Connection()
+		if err != nil {
+			return nil, err
+		}
+		policy, err := getS3UploadPolicy()
+		if err != nil {
+			return nil, err
+		}
+		return newS3ArtifactStore(conn, policy)
+	case "local":
+		dir := os.Getenv("ARTIFACT_DIR")
+		if dir == "" {
+			dir = "artifacts"
+		}
+		return newLocalArtifactStore(dir)
+	case "memory":
+		return newMemoryArtifactStore(), nil
+	default:
+		return nil, fmt.Errorf("Unknown ARTIFACT_STORE: %s, expected s3, local or memory", os.Getenv("ARTIFACT_STORE"))
+	}
+}
+
+// putFile streams the local file at sourcePath to destKey in the store, with the metadata for its kind of artifact
+func putFile(store ArtifactStore, sourcePath, destKey string) error {
+	file, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	return store.Put(destKey, file, putOptionsForKey(destKey))
+}
+
+// LocalArtifactStore keeps artifacts as files beneath a root directory, mirroring the key layout used in S3
+type LocalArtifactStore struct {
+	root string
+}
+
+// newLocalArtifactStore creates the root directory if needed and returns a store writing beneath it
+func newLocalArtifactStore(root string) (*LocalArtifactStore, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(absRoot, 0755); err != nil {
+		return nil, err
+	}
+
+	return &LocalArtifactStore{root: absRoot}, nil
+}
+
+// path maps a key onto a file path beneath the store's root. Keys that would escape the root once cleaned, such as
+// ../outside or runs/../../outside, are rejected, so that a crafted key can't read or write anywhere else
+func (l *LocalArtifactStore) path(key string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(key, "/")))
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", fmt.Errorf("Artifact key %s is outside the store", key)
+	}
+	return filepath.Join(l.root, rel), nil
+}
+
+// Put writes body to the file for key, creating any missing directories
+func (l *LocalArtifactStore) Put(key string, body io.Reader, opts PutOptions) error {
+	dest, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Get reads the file for key
+func (l *LocalArtifactStore) Get(key string) ([]byte, error) {
+	source, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(source)
+}
+
+// List walks the root directory for every file whose key starts with prefix
+func (l *LocalArtifactStore) List(prefix string) ([]string, error) {
+	keys := []string{}
+	walkErr := filepath.Walk(l.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, relErr := filepath.Rel(l.root, p)
+		if relErr != nil {
+			return relErr
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, strings.TrimPrefix(prefix, "/")) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if walkErr != nil {
+		return nil, walkErr
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Delete removes the file for key
+func (l *LocalArtifactStore) Delete(key string) error {
+	target, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// URL returns the file:// address of key, which is empty for a key outside the store
+func (l *LocalArtifactStore) URL(key string) string {
+	target, err := l.path(key)
+	if err != nil {
+		return ""
+	}
+	return "file://" + filepath.ToSlash(target)
+}
+
+// MemoryArtifactStore keeps artifacts in a map, which is useful for tests and dry runs that should not leave anything behind
+type MemoryArtifactStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+// newMemoryArtifactStore returns an empty in-memory store
+func newMemoryArtifactStore() *MemoryArtifactStore {
+	return &MemoryArtifactStore{objects: map[string][]byte{}}
+}
+
+// Put reads body into memory under key
+func (m *MemoryArtifactStore) Put(key string, body io.Reader, opts PutOptions) error {
+	contents, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = contents
+	return nil
+}
+
+// Get returns a copy of the contents stored under key
+func (m *MemoryArtifactStore) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	contents, ok := m.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("No artifact stored at %s", key)
+	}
+	return append([]byte(nil), contents...), nil
+}
+
+// List returns every stored key that starts with prefix
+func (m *MemoryArtifactStore) List(prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := []string{}
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Delete forgets key
+func (m *MemoryArtifactStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+// URL returns a memory:// address for key, which only identifies the artifact in logs
+func (m *MemoryArtifactStore) URL(key string) string {
+	return "memory://" + strings.TrimPrefix(key, "/")
+}
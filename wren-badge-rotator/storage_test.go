@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testArtifactStoreRoundTrip puts, reads, lists, replaces and deletes artifacts in store, which must start out empty beneath
+// prefix, checking the store behaves as the ArtifactStore interface promises
+func testArtifactStoreRoundTrip(t *testing.T, store ArtifactStore, prefix string) {
+	objects := map[string]string{
+		prefix + "runs/2026-10/a/badge.png":  "badge",
+		prefix + "runs/2026-10/a/badge.html": "<html></html>",
+		prefix + "runs/2026-09/b/badge.png":  "older badge",
+		prefix + "manifest.json":             "{}",
+	}
+
+	for key, contents := range objects {
+		if err := store.Put(key, strings.NewReader(contents), putOptionsForKey(key)); err != nil {
+			t.Fatalf("Put(%s): %v", key, err)
+		}
+	}
+
+	for key, want := range objects {
+		got, err := store.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", key, err)
+		}
+		if string(got) != want {
+			t.Errorf("Get(%s) = %q, want %q", key, got, want)
+		}
+	}
+
+	keys, err := store.List(prefix + "runs/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	wantKeys := []string{
+		prefix + "runs/2026-09/b/badge.png",
+		prefix + "runs/2026-10/a/badge.html",
+		prefix + "runs/2026-10/a/badge.png",
+	}
+	if !reflect.DeepEqual(keys, wantKeys) {
+		t.Errorf("List(runs/) = %v, want %v", keys, wantKeys)
+	}
+
+	replaced := prefix + "manifest.json"
+	if err := store.Put(replaced, bytes.NewReader([]byte(`{"runs": []}`)), putOptionsForKey(replaced)); err != nil {
+		t.Fatalf("Put(%s) again: %v", replaced, err)
+	}
+	if got, err := store.Get(replaced); err != nil || string(got) != `{"runs": []}` {
+		t.Errorf("Get(%s) after replacing = %q, %v", replaced, got, err)
+	}
+
+	for key := range objects {
+		if err := store.Delete(key); err != nil {
+			t.Fatalf("Delete(%s): %v", key, err)
+		}
+	}
+	if err := store.Delete(replaced); err != nil {
+		t.Errorf("Delete of a missing key should succeed, got: %v", err)
+	}
+
+	keys, err = store.List(prefix)
+	if err != nil {
+		t.Fatalf("List after deleting: %v", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("List after deleting = %v, want nothing", keys)
+	}
+
+	if _, err := store.Get(replaced); err == nil {
+		t.Errorf("Get(%s) after deleting should fail", replaced)
+	}
+}
+
+func TestMemoryArtifactStore(t *testing.T) {
+	testArtifactStoreRoundTrip(t, newMemoryArtifactStore(), "")
+}
+
+func TestLocalArtifactStore(t *testing.T) {
+	store, err := newLocalArtifactStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testArtifactStoreRoundTrip(t, store, "")
+}
+
+func TestLocalArtifactStoreRejectsEscapingKeys(t *testing.T) {
+	root := t.TempDir()
+	store, err := newLocalArtifactStore(filepath.Join(root, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"../escape.png", "runs/../../escape.png", "/../escape.png", ".."} {
+		if err := store.Put(key, strings.NewReader("badge"), PutOptions{}); err == nil {
+			t.Errorf("Put(%q) succeeded, want an error", key)
+		}
+		if _, err := store.Get(key); err == nil {
+			t.Errorf("Get(%q) succeeded, want an error", key)
+		}
+		if err := store.Delete(key); err == nil {
+			t.Errorf("Delete(%q) succeeded, want an error", key)
+		}
+		if url := store.URL(key); url != "" {
+			t.Errorf("URL(%q) = %q, want empty", key, url)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "escape.png")); !os.IsNotExist(err) {
+		t.Errorf("escape.png was written outside the store root")
+	}
+
+	if err := store.Put("runs/../latest/badge.png", strings.NewReader("badge"), PutOptions{}); err != nil {
+		t.Errorf("Put of a key that stays inside the root failed: %s", err)
+	}
+}
+
+func TestPublishRunRoundTrip(t *testing.T) {
+	store := newMemoryArtifactStore()
+
+	for i, user := range []string{"zackproser", "zackproser"} {
+		run, err := newRun(time.Date(2026, 10, 2+i, 8, 0, 0, 0, time.UTC), user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := run.archiveArtifact(store, ARTIFACT_BADGE_PNG, strings.NewReader("badge")); err != nil {
+			t.Fatal(err)
+		}
+		// Only the first run has a visual diff, which the second run mustn't leave behind in latest/
+		if i == 0 {
+			if err := run.archiveArtifact(store, ARTIFACT_BADGE_DIFF, strings.NewReader("diff")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := publishRun(store, run, true); err != nil {
+			t.Fatal(err)
+		}
+
+		manifest, err := loadManifest(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(manifest.Runs) != i+1 || manifest.Latest != run.ID {
+			t.Errorf("After publishing run %d the manifest has %d runs and latest %s", i+1, len(manifest.Runs), manifest.Latest)
+		}
+	}
+
+	if got, err := store.Get(LATEST_PREFIX + ARTIFACT_BADGE_PNG); err != nil || string(got) != "badge" {
+		t.Errorf("latest badge = %q, %v", got, err)
+	}
+	if _, err := store.Get(LATEST_PREFIX + ARTIFACT_BADGE_DIFF); err == nil {
+		t.Errorf("latest/ still holds the first run's %s", ARTIFACT_BADGE_DIFF)
+	}
+
+	// A run whose delivery failed is recorded in the manifest, but leaves latest/ at the last delivered run
+	manifest, err := loadManifest(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered := manifest.Latest
+
+	failed, err := newRun(time.Date(2026, 10, 4, 8, 0, 0, 0, time.UTC), "zackproser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := failed.archiveArtifact(store, ARTIFACT_BADGE_PNG, strings.NewReader("undelivered badge")); err != nil {
+		t.Fatal(err)
+	}
+	if err := publishRun(store, failed, false); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err = loadManifest(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Runs) != 3 || manifest.Latest != delivered {
+		t.Errorf("After a failed run the manifest has %d runs and latest %s, want 3 and %s", len(manifest.Runs), manifest.Latest, delivered)
+	}
+	if statuses := []string{manifest.Runs[1].Status, manifest.Runs[2].Status}; statuses[0] != RUN_DELIVERED || statuses[1] != RUN_FAILED {
+		t.Errorf("Run statuses = %v, want [%s %s]", statuses, RUN_DELIVERED, RUN_FAILED)
+	}
+	if got, err := store.Get(LATEST_PREFIX + ARTIFACT_BADGE_PNG); err != nil || string(got) != "badge" {
+		t.Errorf("After a failed run, latest badge = %q, %v", got, err)
+	}
+}
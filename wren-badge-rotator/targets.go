@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// targetNamePattern is what a target's name may contain, since it is used in local file and artifact names
+var targetNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Target is a repository the badge is delivered to
+type Target struct {
+	// Name identifies the target in logs, the run's summary and the names of its files and artifacts. It is empty when the
+	// badge is only delivered to the repository configured by REPO_URL
+	Name string
+	// RepoURL is the repository's https clone URL, and BaseBranch the branch the badge update is delivered to
+	RepoURL    string
+	BaseBranch string
+	// Outputs are the files written to the repository
+	Outputs []BadgeOutput
+	// Mode is how the badge update is delivered, one of the DELIVERY_ constants
+	Mode string
+	// AssetsBranch is the orphan branch the badge images and stats are written to, leaving only the README regions embedding
+	// them on the base branch. It is empty when every output is written to the base branch
+	AssetsBranch string
+	// GistID is the gist a target in gist mode publishes the badge to. When it is empty, the user's existing badge gist is used,
+	// or a new one is created
+	GistID string
+	// Forge is the forge hosting RepoURL, one of the FORGE_ constants, and ForgeAPIURL the root of its API. They are empty
+	// when they are worked out from RepoURL
+	Forge       string
+	ForgeAPIURL string
+	// PushToFork pushes the badge branch to a fork of the repository, for credentials that can only read it
+	PushToFork bool
+	// Reviewers are the users and org/team-slug teams asked to review the target's Pull Requests
+	Reviewers []string
+	// GithubAppInstallationID is the Github App installation covering the repository, or 0 when it is looked up
+	GithubAppInstallationID int64
+}
+
+// targetConfig is a target as it is written in the BADGE_TARGETS env var. outputs uses the same kind:path syntax as
+// BADGE_OUTPUTS, and any field left out falls back to the env var configuring it for a single repository
+type targetConfig struct {
+	Name         string `json:"name"`
+	RepoURL      string `json:"repo_url"`
+	BaseBranch   string `json:"base_branch"`
+	Outputs      string `json:"outputs"`
+	DeliveryMode string `json:"delivery_mode"`
+	AssetsBranch string `json:"assets_branch"`
+	GistID       string `json:"gist_id"`
+	Forge        string `json:"forge"`
+	APIURL       string `json:"api_url"`
+	PushToFork   *bool  `json:"push_to_fork"`
+	Reviewers    string `json:"reviewers"`
+	// GithubAppInstallationID is a number, the same as GITHUB_APP_INSTALLATION_ID
+	GithubAppInstallationID int64 `json:"github_app_installation_id"`
+}
+
+// TargetResult is the outcome of delivering the badge to a target
+type TargetResult struct {
+	Target   *Target
+	Delivery DeliveryResult
+	Err      error
+}
+
+// getTargets returns the repositories the badge is delivered to. The BADGE_TARGETS env var lists them as a JSON array such as
+// [{"name": "profile", "repo_url": "https://github.com/zackproser/zackproser.git"}, {"name": "site", "repo_url": "...",
+// "base_branch": "main", "outputs": "badge-svg:static/wren.svg", "delivery_mode": "auto-merge"}, {"delivery_mode": "gist"}].
+// When it is unset, the badge is delivered to the single repository, or gist, configured by REPO_URL, BADGE_OUTPUTS,
+// DELIVERY_MODE, ASSETS_BRANCH, GIST_ID, FORGE, FORGE_API_URL, PUSH_TO_FORK, DELIVERY_REVIEWERS and GITHUB_APP_INSTALLATION_ID
+func getTargets() ([]*Target, error) {
+	configs := []targetConfig{{}}
+
+	if raw := os.Getenv("BADGE_TARGETS"); raw != "" {
+		configs = []targetConfig{}
+		if err := json.Unmarshal([]byte(raw), &configs); err != nil {
+			return nil, fmt.Errorf("BADGE_TARGETS must be a JSON array of targets: %v", err)
+		}
+		if len(configs) == 0 {
+			return nil, fmt.Errorf("BADGE_TARGETS must list at least one target")
+		}
+	}
+
+	targets := []*Target{}
+	names := map[string]bool{}
+
+	for _, config := range configs {
+		target, err := newTarget(config)
+		if err != nil {
+			return nil, err
+		}
+
+		if os.Getenv("BADGE_TARGETS") != "" {
+			if target.Name == "" && target.Mode == DELIVERY_GIST {
+				target.Name = DELIVERY_GIST
+			}
+			if target.Name == "" {
+				// Default to the repository's name, such as zackproser for the profile repository
+				target.Name = strings.TrimSuffix(path.Base(strings.TrimSuffix(target.RepoURL, "/")), ".git")
+			}
+			if !targetNamePattern.MatchString(target.Name) {
+				return nil, fmt.Errorf("Target names may only contain letters, digits, dots, dashes and underscores, got: %s", target.Name)
+			}
+			if names[target.Name] {
+				return nil, fmt.Errorf("More than one target is named %s, give them distinct names", target.Name)
+			}
+			names[target.Name] = true
+		}
+
+		targets = append(targets, target)
+	}
+
+	if err := checkSharedRepositories(targets); err != nil {
+		return nil, err
+	}
+
+	if err := checkSharedGists(targets); err != nil {
+		return nil, err
+	}
+
+	return targets, nil
+}
+
+// checkSharedRepositories makes sure targets delivering Pull Requests to the same repository get separate badge branches,
+// which a BRANCH_NAME_TEMPLATE leaving out the target's name wouldn't give them. They would otherwise force-push over each
+// other's branch, and close each other's Pull Requests as superseded
+func checkSharedRepositories(targets []*Target) error {
+	if strings.Contains(getEnvString("BRANCH_NAME_TEMPLATE", DEFAULT_BRANCH_NAME_TEMPLATE), ".Target") {
+		return nil
+	}
+
+	repos := map[string]*Target{}
+	for _, target := range targets {
+		if target.Mode == DELIVERY_DIRECT || target.Mode == DELIVERY_GIST {
+			continue
+		}
+
+		repo := strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(target.RepoURL, "/"), ".git"))
+		if other, ok := repos[repo]; ok {
+			return fmt.Errorf("Targets %s and %s both open Pull Requests against %s, so BRANCH_NAME_TEMPLATE must include {{.Target}} to give them separate branches",
+				other.Name, target.Name, target.RepoURL)
+		}
+		repos[repo] = target
+	}
+
+	return nil
+}
+
+// checkSharedGists makes sure every gist target publishes to a gist of its own. A gist target without a gist_id, or GIST_ID,
+// finds the user's badge gist, so only one of them may leave it out, and no two may name the same gist, or they would
+// overwrite each other's badge on every run
+func checkSharedGists(targets []*Target) error {
+	gists := map[string]*Target{}
+	for _, target := range targets {
+		if target.Mode != DELIVERY_GIST {
+			continue
+		}
+
+		other, ok := gists[target.GistID]
+		switch {
+		case ok && target.GistID == "":
+			return fmt.Errorf("Gist targets %s and %s both leave out gist_id, so they would both publish to the badge gist. Give each gist target its own gist_id",
+				other.Name, target.Name)
+		case ok:
+			return fmt.Errorf("Gist targets %s and %s both publish to gist %s, give each gist target its own gist_id", other.Name, target.Name, target.GistID)
+		}
+		gists[target.GistID] = target
+	}
+
+	return nil
+}
+
+// newTarget fills in the fields a target config leaves out from the single repository env vars, and validates the rest
+func newTarget(config targetConfig) (*Target, error) {
+	target := &Target{
+		Name:       config.Name,
+		RepoURL:    config.RepoURL,
+		BaseBranch: config.BaseBranch,
+	}
+
+	if target.RepoURL == "" {
+		target.RepoURL = REPO_URL
+	}
+
+	if target.BaseBranch == "" {
+		target.BaseBranch = BADGE_REPO_BASE_BRANCH
+	}
+
+	outputs := config.Outputs
+	if outputs == "" {
+		outputs = getEnvString("BADGE_OUTPUTS", DEFAULT_BADGE_OUTPUTS)
+	}
+
+	var err error
+	target.Outputs, err = parseBadgeOutputs(outputs)
+	if err != nil {
+		return nil, target.wrapErr(err)
+	}
+
+	mode := config.DeliveryMode
+	if mode == "" {
+		mode = os.Getenv("DELIVERY_MODE")
+	}
+
+	target.Mode, err = parseDeliveryMode(mode)
+	if err != nil {
+		return nil, target.wrapErr(err)
+	}
+
+	target.AssetsBranch = config.AssetsBranch
+	if target.AssetsBranch == "" {
+		target.AssetsBranch = os.Getenv("ASSETS_BRANCH")
+	}
+
+	if target.AssetsBranch != "" && target.AssetsBranch == target.BaseBranch {
+		return nil, target.wrapErr(fmt.Errorf("The assets branch must differ from the base branch %s", target.BaseBranch))
+	}
+
+	target.GistID = config.GistID
+	if target.GistID == "" {
+		target.GistID = os.Getenv("GIST_ID")
+	}
+
+	target.Forge = config.Forge
+	if target.Forge == "" {
+		target.Forge = os.Getenv("FORGE")
+	}
+
+	target.ForgeAPIURL = config.APIURL
+	if target.ForgeAPIURL == "" {
+		target.ForgeAPIURL = os.Getenv("FORGE_API_URL")
+	}
+
+	target.PushToFork = getEnvBool("PUSH_TO_FORK")
+	if config.PushToFork != nil {
+		target.PushToFork = *config.PushToFork
+	}
+
+	target.Reviewers = getEnvListFrom(config.Reviewers)
+	if config.Reviewers == "" {
+		target.Reviewers = getEnvList("DELIVERY_REVIEWERS")
+	}
+
+	target.GithubAppInstallationID = config.GithubAppInstallationID
+	if raw := os.Getenv("GITHUB_APP_INSTALLATION_ID"); target.GithubAppInstallationID == 0 && raw != "" {
+		target.GithubAppInstallationID, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, target.wrapErr(fmt.Errorf("GITHUB_APP_INSTALLATION_ID must be a number, got: %s", raw))
+		}
+	}
+
+	if target.Mode == DELIVERY_GIST && target.AssetsBranch != "" {
+		return nil, target.wrapErr(fmt.Errorf("A gist target can't have an assets branch, since it isn't delivered to a repository"))
+	}
+
+	return target, nil
+}
+
+// String names the target for logs
+func (t *Target) String() string {
+	if t.Name == "" {
+		return t.location()
+	}
+	return fmt.Sprintf("%s (%s)", t.Name, t.location())
+}
+
+// location is where the target's badge is delivered: its repository, or its gist
+func (t *Target) location() string {
+	switch {
+	case t.Mode != DELIVERY_GIST:
+		return t.RepoURL
+	case t.GistID == "":
+		return "badge gist"
+	default:
+		return "gist " + t.GistID
+	}
+}
+
+// forgeRepo works out which forge hosts the target's repository, and where its API lives
+func (t *Target) forgeRepo() (ForgeRepo, error) {
+	repo, err := parseForgeRepo(t.RepoURL, t.Forge, t.ForgeAPIURL)
+	repo.InstallationID = t.GithubAppInstallationID
+	return repo, err
+}
+
+// wrapErr says which target an error came from, when there is more than one
+func (t *Target) wrapErr(err error) error {
+	if err == nil || t.Name == "" {
+		return err
+	}
+	return fmt.Errorf("Target %s: %v", t.Name, err)
+}
+
+// fileName makes a local file or artifact name specific to the target, such as badge-diff-site.png for the site target, so
+// that targets delivered concurrently don't overwrite each other's files
+func (t *Target) fileName(name string) string {
+	if t.Name == "" {
+		return name
+	}
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(name, ext), t.Name, ext)
+}
+
+// previousBadgePath is where the badge currently in the target repository is downloaded or copied to, so that it can be
+// compared with the new badge
+func (t *Target) previousBadgePath() string {
+	return t.fileName(PREVIOUS_BADGE_LOCAL_PATH)
+}
+
+// deliverBadge delivers the run's badge to every target concurrently. Each target succeeds or fails independently, and the
+// results are returned in the order the targets are listed
+func deliverBadge(store ArtifactStore, run *Run, targets []*Target) []TargetResult {
+	results := make([]TargetResult, len(targets))
+
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target *Target) {
+			defer wg.Done()
+
+			delivery, err := updateBadgeImage(store, run, target)
+			if err != nil {
+				fmt.Printf("Error delivering badge to %s: %+v\n", target, err)
+			} else {
+				fmt.Printf("Delivered badge to %s as %s\n", target, delivery)
+			}
+
+			results[i] = TargetResult{Target: target, Delivery: delivery, Err: err}
+		}(i, target)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// summarizeDeliveries describes where the badge was delivered, and reports whether every target succeeded. A single target is
+// summarized as its delivery, or its error, while several targets are listed with the outcome of each on its own line
+func summarizeDeliveries(results []TargetResult) (string, bool) {
+	if len(results) == 1 && results[0].Target.Name == "" {
+		if results[0].Err != nil {
+			return results[0].Err.Error(), false
+		}
+		return "as " + results[0].Delivery.String(), true
+	}
+
+	lines := []string{}
+	succeeded := 0
+
+	for _, result := range results {
+		if result.Err != nil {
+			lines = append(lines, fmt.Sprintf("* %s failed: %v", result.Target, result.Err))
+			continue
+		}
+		succeeded++
+		lines = append(lines, fmt.Sprintf("* %s as %s", result.Target, result.Delivery))
+	}
+
+	summary := fmt.Sprintf("to %d of %d targets:\n%s", succeeded, len(results), strings.Join(lines, "\n"))
+	return summary, succeeded == len(results)
+}
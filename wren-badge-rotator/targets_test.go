@@ -0,0 +1,153 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestGetTargetsSharedRepository(t *testing.T) {
+	defer os.Unsetenv("BADGE_TARGETS")
+	defer os.Unsetenv("BRANCH_NAME_TEMPLATE")
+
+	const shared = `[
+		{"name": "profile", "repo_url": "https://github.com/zackproser/zackproser.git"},
+		{"name": "wiki", "repo_url": "https://github.com/zackproser/zackproser", "outputs": "readme-region:WIKI.md"}
+	]`
+
+	tests := []struct {
+		name     string
+		targets  string
+		template string
+		wantErr  bool
+	}{
+		{name: "default template names the target", targets: shared},
+		{name: "template naming the target", targets: shared, template: "wren/{{.Target}}/{{.YearMonth}}"},
+		{name: "template without the target", targets: shared, template: "wren/{{.YearMonth}}", wantErr: true},
+		{
+			name:     "direct delivery has no branch",
+			targets:  `[{"name": "profile", "repo_url": "https://github.com/zackproser/zackproser.git"}, {"name": "wiki", "repo_url": "https://github.com/zackproser/zackproser.git", "delivery_mode": "direct"}]`,
+			template: "wren/{{.YearMonth}}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("BADGE_TARGETS", tt.targets)
+			os.Setenv("BRANCH_NAME_TEMPLATE", tt.template)
+			if tt.template == "" {
+				os.Unsetenv("BRANCH_NAME_TEMPLATE")
+			}
+
+			if _, err := getTargets(); (err != nil) != tt.wantErr {
+				t.Errorf("getTargets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetTargetsForge(t *testing.T) {
+	defer os.Unsetenv("BADGE_TARGETS")
+	defer os.Unsetenv("FORGE")
+	defer os.Unsetenv("FORGE_API_URL")
+
+	os.Setenv("FORGE", FORGE_GITEA)
+	os.Setenv("FORGE_API_URL", "https://git.example.com/api/v1/")
+	os.Setenv("BADGE_TARGETS", `[
+		{"name": "site", "repo_url": "https://git.example.com/zack/site.git"},
+		{"name": "wiki", "repo_url": "https://code.example.org/team/docs/wiki.git", "forge": "gitlab", "api_url": "https://code.example.org/gitlab/api/v4/"}
+	]`)
+
+	targets, err := getTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ForgeRepo{
+		{Kind: FORGE_GITEA, APIURL: "https://git.example.com/api/v1/", Path: "zack/site", WebURL: "https://git.example.com"},
+		{Kind: FORGE_GITLAB, APIURL: "https://code.example.org/gitlab/api/v4/", Path: "team/docs/wiki", WebURL: "https://code.example.org"},
+	}
+	for i, target := range targets {
+		repo, err := target.forgeRepo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if repo != want[i] {
+			t.Errorf("Target %s forge = %+v, want %+v", target.Name, repo, want[i])
+		}
+	}
+}
+
+func TestGetTargetsDeliverySettings(t *testing.T) {
+	defer os.Unsetenv("BADGE_TARGETS")
+	defer os.Unsetenv("PUSH_TO_FORK")
+	defer os.Unsetenv("DELIVERY_REVIEWERS")
+	defer os.Unsetenv("GITHUB_APP_INSTALLATION_ID")
+
+	os.Setenv("PUSH_TO_FORK", "true")
+	os.Setenv("DELIVERY_REVIEWERS", "zackproser, acme/docs")
+	os.Setenv("GITHUB_APP_INSTALLATION_ID", "1234")
+	os.Setenv("BADGE_TARGETS", `[
+		{"name": "profile", "repo_url": "https://github.com/zackproser/zackproser.git"},
+		{"name": "docs", "repo_url": "https://github.com/acme/docs.git", "push_to_fork": false, "reviewers": "acme/writers", "github_app_installation_id": 5678}
+	]`)
+
+	targets, err := getTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Target{
+		{Name: "profile", PushToFork: true, Reviewers: []string{"zackproser", "acme/docs"}, GithubAppInstallationID: 1234},
+		{Name: "docs", PushToFork: false, Reviewers: []string{"acme/writers"}, GithubAppInstallationID: 5678},
+	}
+	for i, target := range targets {
+		if target.PushToFork != want[i].PushToFork || !reflect.DeepEqual(target.Reviewers, want[i].Reviewers) || target.GithubAppInstallationID != want[i].GithubAppInstallationID {
+			t.Errorf("Target %s has push to fork %v, reviewers %v and installation %d, want %v, %v and %d", target.Name,
+				target.PushToFork, target.Reviewers, target.GithubAppInstallationID,
+				want[i].PushToFork, want[i].Reviewers, want[i].GithubAppInstallationID)
+		}
+		repo, err := target.forgeRepo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if repo.InstallationID != want[i].GithubAppInstallationID {
+			t.Errorf("Target %s forge installation = %d, want %d", target.Name, repo.InstallationID, want[i].GithubAppInstallationID)
+		}
+	}
+
+	os.Setenv("GITHUB_APP_INSTALLATION_ID", "not-a-number")
+	if _, err := getTargets(); err == nil {
+		t.Errorf("getTargets() with an invalid GITHUB_APP_INSTALLATION_ID succeeded, want an error")
+	}
+}
+
+func TestGetTargetsSharedGist(t *testing.T) {
+	defer os.Unsetenv("BADGE_TARGETS")
+	defer os.Unsetenv("GIST_ID")
+
+	tests := []struct {
+		name    string
+		targets string
+		gistID  string
+		wantErr bool
+	}{
+		{name: "one gist target without an ID", targets: `[{"delivery_mode": "gist"}, {"name": "profile", "repo_url": "https://github.com/zackproser/zackproser.git"}]`},
+		{name: "gist targets with their own IDs", targets: `[{"name": "a", "delivery_mode": "gist", "gist_id": "aaa"}, {"name": "b", "delivery_mode": "gist", "gist_id": "bbb"}]`},
+		{name: "one gist target falling back to GIST_ID", targets: `[{"name": "a", "delivery_mode": "gist"}, {"name": "b", "delivery_mode": "gist", "gist_id": "bbb"}]`, gistID: "aaa"},
+		{name: "gist targets without IDs", targets: `[{"name": "a", "delivery_mode": "gist"}, {"name": "b", "delivery_mode": "gist", "gist_id": "bbb"}, {"name": "c", "delivery_mode": "gist"}]`, wantErr: true},
+		{name: "gist targets both falling back to GIST_ID", targets: `[{"name": "a", "delivery_mode": "gist"}, {"name": "b", "delivery_mode": "gist"}]`, gistID: "aaa", wantErr: true},
+		{name: "gist targets naming the same gist", targets: `[{"name": "a", "delivery_mode": "gist", "gist_id": "aaa"}, {"name": "b", "delivery_mode": "gist", "gist_id": "aaa"}]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("BADGE_TARGETS", tt.targets)
+			os.Setenv("GIST_ID", tt.gistID)
+
+			if _, err := getTargets(); (err != nil) != tt.wantErr {
+				t.Errorf("getTargets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
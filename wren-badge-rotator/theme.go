@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// BadgeTheme describes the look of the re-styled badge, so that the steps that render, validate and compare the badge image
+// all agree on what a correctly rendered badge should look like
+type BadgeTheme struct {
+	// Name is a short identifier for the theme
+	Name string
+	// BackgroundColor is the hex color of the badge's .container, which should make up most of the rendered image
+	BackgroundColor string
+	// Width and Height are the pixel dimensions the badge is rendered at
+	Width  int
+	Height int
+}
+
+// defaultTheme matches the CSS rules in the wrapper template: a 300x117 green Wren badge
+var defaultTheme = BadgeTheme{
+	Name:            "wren-green",
+	BackgroundColor: "#27AE60",
+	Width:           300,
+	Height:          117,
+}
+
+// parseHexColor converts a CSS hex color such as #27AE60 into an opaque color.RGBA
+func parseHexColor(hex string) (color.RGBA, error) {
+	trimmed := strings.TrimPrefix(hex, "#")
+	if len(trimmed) != 6 {
+		return color.RGBA{}, fmt.Errorf("Invalid hex color: %s", hex)
+	}
+
+	value, err := strconv.ParseUint(trimmed, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("Invalid hex color: %s", hex)
+	}
+
+	return color.RGBA{
+		R: uint8(value >> 16),
+		G: uint8(value >> 8),
+		B: uint8(value),
+		A: 0xff,
+	}, nil
+}
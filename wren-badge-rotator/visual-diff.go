@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+)
+
+const (
+	// SIZE_CHANGE_GAP is the width of the red strip between the previous and new badges in the diff image of a size change
+	SIZE_CHANGE_GAP = 4
+	// PIXEL_CHANGE_TOLERANCE is how far (per channel) a pixel can drift between the old and new badge before it counts as changed,
+	// so that font anti-aliasing differences between renders are not flagged
+	PIXEL_CHANGE_TOLERANCE = 32
+	// DEFAULT_BADGE_DIFF_THRESHOLD is the largest share of changed pixels allowed when BADGE_DIFF_THRESHOLD is not set. A normal
+	// monthly update only swaps a few digits, which changes a small fraction of the image
+	DEFAULT_BADGE_DIFF_THRESHOLD = 0.1
+)
+
+var (
+	// BADGE_DIFF_LOCAL_PATH is where the highlighted difference between the old and new badge is written
+	BADGE_DIFF_LOCAL_PATH = "/tmp/badge-diff.png"
+)
+
+// compareBadgeImages computes the share of pixels that differ between the previous and the new badge images, and writes an
+// image to diffPath in which the unchanged pixels are faded to grey and the changed pixels are highlighted in red. Only the
+// badges themselves are compared, without the padding or page margin around them, in the theme's background color
+func compareBadgeImages(previousPath, currentPath, diffPath string, theme BadgeTheme) (float64, error) {
+	previous, err := decodePNG(previousPath)
+	if err != nil {
+		return 0, err
+	}
+
+	current, err := decodePNG(currentPath)
+	if err != nil {
+		return 0, err
+	}
+
+	background, err := parseHexColor(theme.BackgroundColor)
+	if err != nil {
+		return 0, err
+	}
+
+	// Turning on or changing BADGE_PADDING resizes the image without changing the badge, and badges committed before
+	// post-processing was added still have HCTI's opaque page margin around them, so only the badge itself is compared
+	previous = trimBorder(trimPadding(previous), background)
+	current = trimBorder(trimPadding(current), background)
+
+	// A change in the badge's dimensions means the layout itself changed, so treat the whole image as different
+	if previous.Bounds().Size() != current.Bounds().Size() {
+		return 1, writeSizeChangeImage(previous, current, diffPath)
+	}
+
+	changed := 0
+	bounds := current.Bounds()
+	offset := previous.Bounds().Min.Sub(bounds.Min)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if pixelChanged(previous.At(x+offset.X, y+offset.Y), current.At(x, y)) {
+				changed++
+			}
+		}
+	}
+
+	return float64(changed) / float64(bounds.Dx()*bounds.Dy()), writeDiffImage(previous, current, diffPath)
+}
+
+// writeDiffImage renders the highlighted difference between previous and current and writes it to diffPath as a PNG
+func writeDiffImage(previous, current image.Image, diffPath string) error {
+	bounds := current.Bounds()
+	offset := previous.Bounds().Min.Sub(bounds.Min)
+	diff := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var c color.Color
+			if !image.Pt(x+offset.X, y+offset.Y).In(previous.Bounds()) || pixelChanged(previous.At(x+offset.X, y+offset.Y), current.At(x, y)) {
+				c = color.RGBA{R: 0xff, A: 0xff}
+			} else {
+				gray := color.GrayModel.Convert(current.At(x, y)).(color.Gray)
+				// Lighten the unchanged pixels so the highlighted changes stand out
+				c = color.Gray{Y: gray.Y/4 + 0xbf}
+			}
+			diff.Set(x-bounds.Min.X, y-bounds.Min.Y, c)
+		}
+	}
+
+	file, err := os.Create(diffPath)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	return png.Encode(file, diff)
+}
+
+// writeSizeChangeImage writes the previous and current badges side by side to diffPath as a PNG, on a red background marking
+// every pixel as changed, since badges of different sizes can't be compared pixel by pixel
+func writeSizeChangeImage(previous, current image.Image, diffPath string) error {
+	width := previous.Bounds().Dx() + SIZE_CHANGE_GAP + current.Bounds().Dx()
+	height := previous.Bounds().Dy()
+	if current.Bounds().Dy() > height {
+		height = current.Bounds().Dy()
+	}
+
+	diff := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(diff, diff.Bounds(), image.NewUniform(color.RGBA{R: 0xff, A: 0xff}), image.Point{}, draw.Src)
+	draw.Draw(diff, previous.Bounds().Sub(previous.Bounds().Min), previous, previous.Bounds().Min, draw.Over)
+	draw.Draw(diff, current.Bounds().Sub(current.Bounds().Min).Add(image.Pt(previous.Bounds().Dx()+SIZE_CHANGE_GAP, 0)),
+		current, current.Bounds().Min, draw.Over)
+
+	file, err := os.Create(diffPath)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	return png.Encode(file, diff)
+}
+
+// pixelChanged reports whether two pixels differ by more than PIXEL_CHANGE_TOLERANCE on any channel
+func pixelChanged(a, b color.Color) bool {
+	return !colorsWithinTolerance(
+		color.RGBAModel.Convert(a).(color.RGBA),
+		color.RGBAModel.Convert(b).(color.RGBA),
+		PIXEL_CHANGE_TOLERANCE,
+	)
+}
+
+// trimPadding crops away the fully transparent rows and columns around the image, such as those added by BADGE_PADDING. The
+// cropped image keeps its coordinates, which the comparison above offsets between
+func trimPadding(img image.Image) image.Image {
+	bounds := img.Bounds()
+	content := image.Rectangle{}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0 {
+				content = content.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+
+	cropper, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	})
+	if !ok || content.Empty() {
+		return img
+	}
+
+	return cropper.SubImage(content)
+}
+
+// decodePNG opens and decodes the PNG image at imagePath
+func decodePNG(imagePath string) (image.Image, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	return png.Decode(file)
+}
+
+// checkVisualRegression compares the badge currently committed to the profile repository with the newly extracted badge,
+// and returns an error if they differ by more than the configured threshold, since that points to a broken render rather than
+// a monthly stats update. Setting FORCE_BADGE_UPDATE=true allows the update through regardless. The highlighted diff image is
+// uploaded to the artifact store either way so that it can be reviewed. The badge currently committed to the target repository
+// is read from its previousBadgePath, and the diff is named after the target, since each target's current badge can differ
+func checkVisualRegression(store ArtifactStore, run *Run, target *Target) error {
+	previousBadgePath := target.previousBadgePath()
+	diffPath := target.fileName(BADGE_DIFF_LOCAL_PATH)
+	diffArtifact := target.fileName(ARTIFACT_BADGE_DIFF)
+
+	if _, statErr := os.Stat(previousBadgePath); os.IsNotExist(statErr) {
+		fmt.Printf("No existing badge found at %s, skipping visual regression check\n", previousBadgePath)
+		return nil
+	}
+
+	threshold, thresholdErr := getEnvFloat("BADGE_DIFF_THRESHOLD", DEFAULT_BADGE_DIFF_THRESHOLD)
+	if thresholdErr != nil {
+		return thresholdErr
+	}
+
+	difference, compareErr := compareBadgeImages(previousBadgePath, EXTRACTED_BADGE_IMAGE_LOCAL_PATH, diffPath, defaultTheme)
+	if compareErr != nil {
+		return compareErr
+	}
+
+	fmt.Printf("New badge differs from the current badge in %s by %.2f%% of pixels (threshold %.2f%%)\n", target, difference*100, threshold*100)
+
+	uploadErr := run.archiveFile(store, diffArtifact, diffPath)
+	if uploadErr != nil {
+		fmt.Printf("Error uploading badge diff image: %+v\n", uploadErr)
+	}
+
+	if difference <= threshold {
+		return nil
+	}
+
+	if getEnvBool("FORCE_BADGE_UPDATE") {
+		fmt.Println("Badge difference exceeds threshold, but FORCE_BADGE_UPDATE is set, continuing")
+		return nil
+	}
+
+	return fmt.Errorf("New badge differs from the current badge by %.2f%% of pixels, exceeding the %.2f%% threshold. Review %s or set FORCE_BADGE_UPDATE=true",
+		difference*100, threshold*100, run.key(diffArtifact))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePostProcessedBadge writes the badge at badgePath the way post-processing publishes it: trimmed, with rounded corners
+// and transparent padding
+func writePostProcessedBadge(t *testing.T, badgePath string, padding int) string {
+	img, err := decodePNG(badgePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	background, err := parseHexColor(defaultTheme.BackgroundColor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	processed := addPadding(roundCorners(trimBorder(img, background), 6), padding)
+
+	processedPath := filepath.Join(t.TempDir(), "processed.png")
+	file, err := os.Create(processedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if err := png.Encode(file, processed); err != nil {
+		t.Fatal(err)
+	}
+	return processedPath
+}
+
+func TestCompareBadgeImages(t *testing.T) {
+	hctiBadge := writeTestBadge(t, defaultTheme.Width, defaultTheme.Height, 8)
+	widerBadge := writeTestBadge(t, defaultTheme.Width+20, defaultTheme.Height, 0)
+
+	tests := []struct {
+		name         string
+		previous     string
+		current      string
+		wantBlocked  bool
+		wantDiffSize image.Point
+	}{
+		{
+			name:         "badge committed before post-processing",
+			previous:     hctiBadge,
+			current:      writePostProcessedBadge(t, hctiBadge, 0),
+			wantDiffSize: image.Pt(defaultTheme.Width, defaultTheme.Height),
+		},
+		{
+			name:         "padding changed",
+			previous:     writePostProcessedBadge(t, hctiBadge, 0),
+			current:      writePostProcessedBadge(t, hctiBadge, 10),
+			wantDiffSize: image.Pt(defaultTheme.Width, defaultTheme.Height),
+		},
+		{
+			name:         "size changed",
+			previous:     hctiBadge,
+			current:      widerBadge,
+			wantBlocked:  true,
+			wantDiffSize: image.Pt(defaultTheme.Width*2+20+SIZE_CHANGE_GAP, defaultTheme.Height),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diffPath := filepath.Join(t.TempDir(), "diff.png")
+
+			difference, err := compareBadgeImages(tt.previous, tt.current, diffPath, defaultTheme)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Rounding the corners changes a few pixels, which a monthly update easily absorbs
+			if blocked := difference > DEFAULT_BADGE_DIFF_THRESHOLD; blocked != tt.wantBlocked {
+				t.Errorf("compareBadgeImages() = %v, want blocked %v", difference, tt.wantBlocked)
+			}
+
+			diff, err := decodePNG(diffPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := diff.Bounds().Size(); size != tt.wantDiffSize {
+				t.Errorf("The diff image is %v, want %v", size, tt.wantDiffSize)
+			}
+		})
+	}
+}